@@ -1,9 +1,15 @@
 package mqtt
 
-import "context"
+import (
+	"context"
+	"iter"
+	"time"
+)
 
 var (
-	// DisconnectedErr returned when client disconnected.
+	// DisconnectedErr is the message of ErrDisconnected.
+	//
+	// Deprecated: use errors.Is(err, ErrDisconnected) to check the error.
 	DisconnectedErr = "client disconnected"
 )
 
@@ -22,6 +28,10 @@ type Client interface {
 	// Pushlish push message to topic
 	Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error
 
+	// PublishAsync sends message to topic without waiting for the PUBACK,
+	// the returned Token completes when the message is acknowledged(QoS 1) or written(QoS 0).
+	PublishAsync(ctx context.Context, topic string, qos byte, retained bool, payload []byte) Token
+
 	// Subscribe subscribes a single topic. Callback could be nil
 	Subscribe(ctx context.Context, topic string, qos byte, callback MessageHandler) error
 
@@ -33,11 +43,34 @@ type Client interface {
 
 	// SetRoute set the callback of topic, and overide the callback setting in Subscribe or SubscribeMultiple
 	SetRoute(topic string, callback MessageHandler)
+
+	// Messages subscribes filters and returns an iterator of the messages received,
+	// the subscription is cleaned up when the loop breaks or ctx is done.
+	Messages(ctx context.Context, filters ...string) iter.Seq2[Message, error]
+
+	// ClearRetained removes the retained message of topic by publishing an empty retained message.
+	ClearRetained(ctx context.Context, topic string) error
+
+	// FetchRetained returns the retained messages matching filter, it waits until no new retained
+	// message arrives in settle time.
+	FetchRetained(ctx context.Context, filter string, settle time.Duration) ([]Message, error)
+
+	// GetOnce waits for the first message matching filter, eg: the current state in retained topic.
+	GetOnce(ctx context.Context, filter string) (Message, error)
+
+	// Request publishes payload to topic and waits for the response sent by Responder.
+	Request(ctx context.Context, topic string, payload []byte) ([]byte, error)
+
+	// Stats returns a snapshot of the connection status and counters.
+	Stats() Stats
+
+	// Ping sends PINGREQ and returns the round trip time when PINGRESP arrives.
+	Ping(ctx context.Context) (time.Duration, error)
 }
 
 // MessageHandler is a callback type which can be set to be
 // executed upon the arrival of messages published to topics
-// to which the client is subscribed.
+// to which the client is subscribed. Use HandleContext to receive a context.
 type MessageHandler func(Message)
 
 // Message define the interface of mqtt message(no QoS, retained info here)
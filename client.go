@@ -1,10 +1,11 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/url"
 	"sync"
@@ -12,53 +13,104 @@ import (
 	"time"
 
 	"github.com/openim/mqtt-client/packet"
+	"github.com/openim/mqtt-client/topic"
 )
 
 type client struct {
-	sync.Mutex   // TODO: protect both conn and ID ?
-	conn         net.Conn
-	isConnected  int64 // 0 -- disconnected, 1 -- connected
-	options      Options
-	nextPacketID uint16
-	handler      *messageHandler
-
-	respWaitingQueueMutex sync.Mutex
-	respWaitingQueue      map[requestKey]chan interface{}
-
-	timerResetChan       chan int
-	exitChan             chan struct{}
+	sync.Mutex  // TODO: protect conn ?
+	conn        net.Conn
+	server      atomic.Pointer[url.URL] // the server connected or connecting
+	isConnected int64                   // 0 -- disconnected, 1 -- connected
+	options     Options
+	handler     *messageHandler
+	subsLock    sync.Mutex     // orders the route changes with SUBSCRIBE and UNSUBSCRIBE, see unsubscribeUnrouted
+	dispatch    MessageHandler // handler wrapped with middlewares
+	publish     PublishFunc    // sendPublication wrapped with interceptors
+	inflight    *inflightTable // packets waiting for response
+	limiter     *rateLimiter
+	metrics     Metrics
+	connects    int64 // number of connections established
+
+	state *connState // the current connection, guarded by the Mutex
+
+	repliesLock sync.Mutex
+	replies     replies
+
+	pingsLock      sync.Mutex
+	pings          []*pendingPing // in the order of sending
+	counters       counters
+	sessionPresent atomic.Bool
+	connectedAt    atomic.Int64 // unix nano
+	lastPingRTT    atomic.Int64 // nanoseconds
+
+	timerResetChan chan int
+	wg             sync.WaitGroup
+}
+
+// connState is the state of a connection, start replaces it for each connection. The loops of a connection
+// and the callers waiting on it capture it once, so they are not affected by the next connection.
+type connState struct {
+	outgoing             *outgoingQueue  // packets waiting for writeLoop
+	dispatcher           *dispatcher     // nil if handlers run inline
+	handlerCtx           context.Context // cancelled on Disconnect, parent of the message contexts
+	cancelHandler        context.CancelFunc
+	exitChan             chan struct{} // closed by Disconnect
 	outgoingLoopExitChan chan struct{} // incoming error occured, and notify outgoingLoop
-	wg                   sync.WaitGroup
 }
 
-type requestKey struct {
-	msgType byte
-	id      uint16
+func newConnState() *connState {
+	return &connState{
+		outgoing:             newOutgoingQueue(),
+		exitChan:             make(chan struct{}),
+		outgoingLoopExitChan: make(chan struct{}),
+	}
 }
 
 // NewClient create a new mqtt client(no reconn and retry, message pending will abandoned)
 func NewClient(options Options) Client {
 	c := &client{
-		options:              options,
-		nextPacketID:         0,
-		handler:              &messageHandler{},
-		respWaitingQueue:     make(map[requestKey]chan interface{}),
-		timerResetChan:       make(chan int, 1),
-		outgoingLoopExitChan: make(chan struct{}),
-		exitChan:             make(chan struct{}),
+		options:        options,
+		replies:        newReplies(options.ReplyTopicPrefix),
+		limiter:        newRateLimiter(&options),
+		state:          newConnState(),
+		timerResetChan: make(chan int, 1),
+	}
+	c.metrics = options.Metrics
+	if c.metrics == nil {
+		c.metrics = nopMetrics{}
 	}
-	return c
-}
 
-func (c *client) IsConnected() bool {
-	return atomic.LoadInt64(&c.isConnected) == 1
+	c.inflight = newInflightTable(options.MaxInflight, c.metrics.Inflight)
+	c.handler = newMessageHandler(LoggerFunc(c.log))
+	handle := Chain(func(msg Message) {
+		if err := c.handler.Handle(msg); err != nil {
+			c.log(LogError, "failed to process message", LogFieldTopic, msg.Topic(), LogFieldError, err)
+		}
+	}, options.Middlewares...)
+	c.dispatch = func(msg Message) {
+		start := time.Now()
+		handle(msg)
+		c.metrics.HandlerDone(msg.Topic(), time.Since(start))
+	}
+	c.publish = chainPublishInterceptors(c.sendPublication, options.PublishInterceptors...)
+	return c
 }
 
-func (c *client) getPacketID() uint16 {
+// connection returns the state of the current connection.
+func (c *client) connection() *connState {
 	c.Lock()
 	defer c.Unlock()
-	c.nextPacketID++
-	return c.nextPacketID
+	return c.state
+}
+
+// exitChans returns the channels closed when the current connection ends, by Disconnect or connection loss.
+func (c *client) exitChans() (exitChan, connExitChan <-chan struct{}) {
+	st := c.connection()
+	return st.exitChan, st.outgoingLoopExitChan
+}
+
+func (c *client) IsConnected() bool {
+	return atomic.LoadInt64(&c.isConnected) == 1
 }
 
 func (c *client) Connect(ctx context.Context) error {
@@ -66,10 +118,11 @@ func (c *client) Connect(ctx context.Context) error {
 	for _, s := range c.options.Servers {
 		err := c.connect(ctx, s)
 		if err == nil {
+			c.metrics.Connected(atomic.AddInt64(&c.connects, 1) > 1)
 			return c.start(ctx)
 		}
 
-		log.Printf("failed to connect to %s, %s", s, err)
+		c.log(LogWarn, "failed to connect", LogFieldError, err)
 		lasterr = err
 	}
 
@@ -77,55 +130,144 @@ func (c *client) Connect(ctx context.Context) error {
 }
 
 func (c *client) start(ctx context.Context) error {
+	st := newConnState()
+	st.handlerCtx, st.cancelHandler = context.WithCancel(context.WithValue(context.Background(), loggerKey{}, LoggerFunc(c.log)))
+	st.outgoing.open()
+	if c.options.DispatchWorkers > 0 {
+		st.dispatcher = newDispatcher(&c.options, c.dispatch, &c.wg, LoggerFunc(c.log))
+		st.dispatcher.start()
+	}
+
+	c.Lock()
+	c.state = st
+	c.Unlock()
+	c.connectedAt.Store(time.Now().UnixNano())
+	c.inflight.open()
+	c.repliesLock.Lock()
+	c.replies.subscribed = false
+	c.repliesLock.Unlock()
 	atomic.StoreInt64(&c.isConnected, 1)
-	c.exitChan = make(chan struct{})
-	c.wg.Add(2)
-	go c.incomingLoop(c.conn) // TODO: incoming return error, should notify to outgoing
-	go c.outgoingLoop(c.conn) // outgoing error should close the incomingLoop
+
+	c.wg.Add(3)
+	go c.incomingLoop(c.conn, st) // TODO: incoming return error, should notify to outgoing
+	go c.outgoingLoop(c.conn, st) // outgoing error should close the incomingLoop
+	go c.writeLoop(c.conn, st)
 	// the two loops exits, and we can start to try reconnect.
 	return nil
 }
 
 func (c *client) Disconnect() error {
+	st := c.connection()
 	if !c.IsConnected() {
-		return errors.New("not connected")
+		// the connection might be lost already, the handlers and loops of it still need to be stopped
+		if st.cancelHandler != nil {
+			st.cancelHandler()
+			c.wg.Wait()
+		}
+		return ErrNotConnected
 	}
 
+	c.log(LogInfo, "disconnect")
 	msg := &packet.DisConnect{}
 	c.sendPacket(msg)
 	c.conn.Close()
-	close(c.exitChan)
+	st.cancelHandler()
+	close(st.exitChan)
 	atomic.StoreInt64(&c.isConnected, 0)
 	c.wg.Wait()
 	return nil
 }
 
-func (c *client) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+func (c *client) Publish(ctx context.Context, name string, qos byte, retained bool, payload []byte) error {
 	// retry logic?
 	// reconn logic?
 	// qos level setting error?
-	// topicFilter name invalid
-	return c.cmdPublish(ctx, topic, qos, false, retained, payload)
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	return c.publish(ctx, &Publication{name, qos, retained, payload})
 }
 
-func (c *client) Subscribe(ctx context.Context, topic string, qos byte, callback MessageHandler) error {
-	// only network problem? qos level setting error? topicFilter name invalid
-	return c.cmdSubscribe(ctx, topic, qos, callback)
+func (c *client) PublishAsync(ctx context.Context, name string, qos byte, retained bool, payload []byte) Token {
+	if !c.IsConnected() {
+		return newCompletedToken(ErrNotConnected)
+	}
+
+	var tok *token
+	err := c.publish(context.WithValue(ctx, asyncPublishKey{}, &tok), &Publication{name, qos, retained, payload})
+	if err != nil || tok == nil { // failed or rejected by interceptors
+		return newCompletedToken(err)
+	}
+
+	return tok
+}
+
+// asyncPublishKey carries the token of PublishAsync to sendPublication.
+type asyncPublishKey struct{}
+
+// sendPublication is the end of the PublishInterceptor chain, it publishes asynchronously
+// if called by PublishAsync, and waits for the PUBACK otherwise.
+func (c *client) sendPublication(ctx context.Context, p *Publication) error {
+	if err := topic.ValidateName(p.Topic); err != nil {
+		return err
+	}
+
+	if tok, ok := ctx.Value(asyncPublishKey{}).(**token); ok {
+		*tok = c.cmdPublishAsync(ctx, p.Topic, p.Qos, false, p.Retained, p.Payload)
+		return (*tok).Err()
+	}
+
+	return c.cmdPublish(ctx, p.Topic, p.Qos, false, p.Retained, p.Payload)
+}
+
+func (c *client) Subscribe(ctx context.Context, filter string, qos byte, callback MessageHandler) error {
+	// only network problem? qos level setting error?
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err
+	}
+
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	return c.cmdSubscribe(ctx, filter, qos, callback)
 }
 
 func (c *client) SubscribeMultiple(ctx context.Context, filters map[string]byte, callback MessageHandler) error {
-	panic("not implemented")
+	for f := range filters {
+		if err := topic.ValidateFilter(f); err != nil {
+			return err
+		}
+	}
+
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	return c.cmdSubscribeMultiple(ctx, filters, callback)
 }
 
-func (c *client) Unsubscribe(ctx context.Context, topics ...string) error {
-	return c.cmdUnsubscribe(ctx, topics...)
+func (c *client) Unsubscribe(ctx context.Context, filters ...string) error {
+	for _, f := range filters {
+		if err := topic.ValidateFilter(f); err != nil {
+			return err
+		}
+	}
+
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	return c.cmdUnsubscribe(ctx, filters...)
 }
 
 func (c *client) SetRoute(topic string, callback MessageHandler) {
-	panic("not implemented")
+	c.handler.Register(topic, 0, callback)
 }
 
 func (c *client) connect(ctx context.Context, url *url.URL) error {
+	c.server.Store(url)
 	switch url.Scheme {
 	case "tcp":
 		d := net.Dialer{
@@ -134,7 +276,7 @@ func (c *client) connect(ctx context.Context, url *url.URL) error {
 
 		conn, err := d.DialContext(ctx, "tcp", url.Host)
 		if err != nil {
-			return err
+			return wrapTimeout(err)
 		}
 
 		c.setConn(conn)
@@ -151,37 +293,48 @@ func (c *client) setConn(conn net.Conn) {
 	c.Unlock()
 }
 
-func (c *client) incomingLoop(conn net.Conn) error {
+func (c *client) incomingLoop(conn net.Conn, st *connState) error {
 	defer c.wg.Done()
 	var retErr error
 	for {
 		c.conn.SetReadDeadline(time.Now().Add(c.options.KeepAlive * 2))
-		pkt, err := packet.ReadPacket(conn)
+		pkt, err := c.readPacket(conn)
 		if err != nil {
-			log.Printf("failed to read packet, %s", err)
+			c.log(LogError, "failed to read packet", LogFieldError, err)
 			atomic.StoreInt64(&c.isConnected, 0)
 			retErr = err
 			goto EXIT
 		}
 
+		c.log(LogDebug, "receive packet", packetFields(pkt)...)
 		switch v := pkt.(type) {
 		case *packet.PubAck:
-			ch, ok := c.getRequestFromQueue(packet.CtrlTypePUBACK, v.ID)
+			tok, ok := c.inflight.release(packet.CtrlTypePUBACK, v.ID)
 			if !ok {
-				log.Printf("receive invalid puback, id=%d", v.ID)
+				c.log(LogWarn, "receive unexpected ack", packetFields(v)...)
 				continue
 			}
-			ch <- v
+			if !tok.sentAt.IsZero() {
+				c.metrics.PublishAcked(time.Since(tok.sentAt))
+			}
+			tok.complete(v, nil)
 		case *packet.SubAck:
-			ch, ok := c.getRequestFromQueue(packet.CtrlTypeSUBACK, v.ID)
+			tok, ok := c.inflight.release(packet.CtrlTypeSUBACK, v.ID)
 			if !ok {
-				log.Printf("receive invalid suback, id=%d", v.ID)
+				c.log(LogWarn, "receive unexpected ack", packetFields(v)...)
 				continue
 			}
-			ch <- v
+			tok.complete(v, nil)
 		case *packet.Publish:
-			if err := c.handler.Handle(&message{v.Topic, v.Payload}); err != nil {
-				log.Printf("failed to process message, %s", v)
+			msg := c.newMessage(st.handlerCtx, v)
+			if st.dispatcher != nil {
+				st.dispatcher.dispatch(msg, st.exitChan)
+			} else {
+				c.dispatch(msg)
+			}
+
+			if v.QosLevel == packet.Qos0 {
+				continue
 			}
 
 			if err := c.sendPublishAck(conn, v); err != nil {
@@ -189,26 +342,48 @@ func (c *client) incomingLoop(conn net.Conn) error {
 				goto EXIT
 			}
 		case *packet.UnSubAck:
-			ch, ok := c.getRequestFromQueue(packet.CtrlTypeUNSUBACK, v.ID)
+			tok, ok := c.inflight.release(packet.CtrlTypeUNSUBACK, v.ID)
 			if !ok {
-				log.Printf("receive invalid unsuback, id=%d", v.ID)
+				c.log(LogWarn, "receive unexpected ack", packetFields(v)...)
 				continue
 			}
-			ch <- v
+			tok.complete(v, nil)
 		case *packet.PingResp:
-			// reset read timer, do nothing
+			c.pingResponded()
 		default:
-			log.Printf("invalid message type, %+v", v)
+			c.log(LogWarn, "receive unexpected packet", packetFields(v)...)
 		}
 	}
 
 EXIT:
 	conn.Close()
-	close(c.outgoingLoopExitChan)
+	if st.dispatcher != nil {
+		st.dispatcher.stop()
+	}
+	c.inflight.failAll(fmt.Errorf("%w, %w", ErrDisconnected, retErr))
+	c.failPings()
+	close(st.outgoingLoopExitChan)
 	return retErr
 }
 
-func (c *client) outgoingLoop(conn net.Conn) {
+func (c *client) newMessage(ctx context.Context, p *packet.Publish) *message {
+	info := MessageInfo{
+		Topic:      p.Topic,
+		PacketID:   p.ID,
+		Qos:        p.QosLevel,
+		Retained:   p.RetainFlag,
+		ReceivedAt: time.Now(),
+	}
+
+	return &message{
+		ctx:      context.WithValue(ctx, messageInfoKey{}, info),
+		topic:    p.Topic,
+		payload:  p.Payload,
+		retained: p.RetainFlag,
+	}
+}
+
+func (c *client) outgoingLoop(conn net.Conn, st *connState) {
 	defer c.wg.Done()
 	keepAliveTimer := time.NewTimer(c.options.KeepAlive)
 	defer keepAliveTimer.Stop()
@@ -217,9 +392,9 @@ func (c *client) outgoingLoop(conn net.Conn) {
 		case <-keepAliveTimer.C:
 			c.sendPingReq(conn)
 		case <-c.timerResetChan:
-		case <-c.outgoingLoopExitChan:
+		case <-st.outgoingLoopExitChan:
 			goto EXIT
-		case <-c.exitChan:
+		case <-st.exitChan:
 			goto EXIT
 		}
 		keepAliveTimer = time.NewTimer(c.options.KeepAlive)
@@ -229,15 +404,8 @@ EXIT:
 	conn.Close()
 }
 
-func (c *client) getRequestFromQueue(msgType byte, msgID uint16) (ch chan interface{}, ok bool) {
-	c.respWaitingQueueMutex.Lock()
-	ch, ok = c.respWaitingQueue[requestKey{msgType, msgID}]
-	c.respWaitingQueueMutex.Unlock()
-	return
-}
-
-func (c *client) waitPubAck(ctx context.Context, id uint16) (*packet.PubAck, error) {
-	v, err := c.waitResp(ctx, packet.CtrlTypePUBACK, id)
+func (c *client) waitPubAck(ctx context.Context, tok *token) (*packet.PubAck, error) {
+	v, err := c.waitResp(ctx, tok)
 	if err != nil {
 		return nil, err
 	}
@@ -245,8 +413,8 @@ func (c *client) waitPubAck(ctx context.Context, id uint16) (*packet.PubAck, err
 	return v.(*packet.PubAck), nil
 }
 
-func (c *client) waitSubAck(ctx context.Context, id uint16) (*packet.SubAck, error) {
-	v, err := c.waitResp(ctx, packet.CtrlTypeSUBACK, id)
+func (c *client) waitSubAck(ctx context.Context, tok *token) (*packet.SubAck, error) {
+	v, err := c.waitResp(ctx, tok)
 	if err != nil {
 		return nil, err
 	}
@@ -254,8 +422,8 @@ func (c *client) waitSubAck(ctx context.Context, id uint16) (*packet.SubAck, err
 	return v.(*packet.SubAck), nil
 }
 
-func (c *client) waitUnsubAck(ctx context.Context, id uint16) (*packet.UnSubAck, error) {
-	v, err := c.waitResp(ctx, packet.CtrlTypeUNSUBACK, id)
+func (c *client) waitUnsubAck(ctx context.Context, tok *token) (*packet.UnSubAck, error) {
+	v, err := c.waitResp(ctx, tok)
 	if err != nil {
 		return nil, err
 	}
@@ -263,19 +431,15 @@ func (c *client) waitUnsubAck(ctx context.Context, id uint16) (*packet.UnSubAck,
 	return v.(*packet.UnSubAck), nil
 }
 
-func (c *client) waitResp(ctx context.Context, msgType byte, id uint16) (interface{}, error) {
-	respChan := make(chan interface{})
-	c.respWaitingQueueMutex.Lock()
-	c.respWaitingQueue[requestKey{msgType, id}] = respChan
-	c.respWaitingQueueMutex.Unlock()
-	select {
-	case resp := <-respChan:
-		return resp, nil
-	case <-ctx.Done():
-		log.Printf("wait resp timeout")
-		return nil, ctx.Err()
+// waitResp waits the response of request, the request is removed from in-flight table if ctx is done.
+func (c *client) waitResp(ctx context.Context, tok *token) (interface{}, error) {
+	if err := tok.Wait(ctx); err != nil {
+		c.log(LogDebug, "wait response failed", LogFieldPacketID, tok.id, LogFieldError, err)
+		c.inflight.cancel(tok.id, tok)
+		return nil, wrapTimeout(err)
 	}
 
+	return tok.resp, nil
 }
 
 func (c *client) sendPublishAck(conn net.Conn, p *packet.Publish) error {
@@ -283,21 +447,102 @@ func (c *client) sendPublishAck(conn net.Conn, p *packet.Publish) error {
 }
 
 func (c *client) sendPingReq(conn net.Conn) error {
-	return c.sendPacket(&packet.PingReq{})
+	return c.sendPing(nil)
 }
 
-type writer interface {
-	Write(w io.Writer) error
+// readPacket reads a packet from r, and reports it to the metrics and packet tap.
+func (c *client) readPacket(r io.Reader) (packet.ControlPacket, error) {
+	cr := &countingReader{r: r}
+	var src io.Reader = cr
+	var raw *bytes.Buffer
+	if c.options.PacketTap != nil {
+		raw = &bytes.Buffer{}
+		src = io.TeeReader(cr, raw)
+	}
+
+	pkt, err := packet.ReadPacket(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.metrics.PacketReceived(packetType(pkt), cr.n)
+	c.counters.packetsReceived.Add(1)
+	c.counters.bytesReceived.Add(uint64(cr.n))
+	if raw != nil {
+		c.options.PacketTap(PacketEvent{DirectionIn, time.Now(), pkt, raw.Bytes()})
+	}
+	return pkt, nil
 }
 
-func (c *client) sendPacket(p writer) error {
-	c.Lock()
-	defer c.Unlock()
-	err := p.Write(c.conn)
+// sendPacket queues the control packet p ahead of PUBLISH packets, and waits until it's written.
+func (c *client) sendPacket(p packet.ControlPacket) error {
+	return c.sendPacketLane(context.Background(), p, laneControl)
+}
+
+// sendPacketLane encodes p before queueing, so the raw bytes could be measured and tapped.
+// If ctx is done while p is queued, it's removed from the queue and not written.
+func (c *client) sendPacketLane(ctx context.Context, p packet.ControlPacket, lane int) error {
+	raw, err := encodePacket(p)
 	if err != nil {
 		return err
 	}
 
-	c.timerResetChan <- 0
+	q := c.connection().outgoing
+	o := &outgoing{p, raw, make(chan error, 1)}
+	if err := q.push(lane, o); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-o.done:
+		return err
+	case <-ctx.Done():
+		if q.remove(lane, o) {
+			return wrapTimeout(ctx.Err())
+		}
+
+		return <-o.done // being written, it can't be stopped without breaking the stream
+	}
+}
+
+func encodePacket(p packet.ControlPacket) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := p.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writePacket writes the encoded packet p to w, it's called by writeLoop only, or before it started.
+// w might be buffered, packetSent is called after the packet reaches the connection.
+func (c *client) writePacket(w io.Writer, p packet.ControlPacket, raw []byte) error {
+	if c.options.PacketTap != nil { // tapped before writing, so it's always ahead of the response
+		c.options.PacketTap(PacketEvent{DirectionOut, time.Now(), p, raw})
+	}
+
+	// recorded before writing, so it's always ahead of the PUBACK
+	if pub, ok := p.(*packet.Publish); ok && pub.QosLevel > packet.Qos0 {
+		c.inflight.sent(packet.CtrlTypePUBACK, pub.ID, time.Now())
+	}
+
+	if _, err := w.Write(raw); err != nil {
+		c.log(LogError, "failed to send packet", append(packetFields(p), LogFieldError, err)...)
+		return err
+	}
+
 	return nil
 }
+
+// packetSent records the packet written to the connection.
+func (c *client) packetSent(p packet.ControlPacket, raw []byte) {
+	c.log(LogDebug, "send packet", packetFields(p)...)
+	c.metrics.PacketSent(packetType(p), len(raw))
+	c.counters.packetsSent.Add(1)
+	c.counters.bytesSent.Add(uint64(len(raw)))
+
+	select {
+	case c.timerResetChan <- 0:
+	default: // reset already pending, or outgoingLoop exited
+	}
+}
@@ -2,9 +2,9 @@ package mqtt
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"log"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/openim/mqtt-client/packet"
@@ -20,110 +20,238 @@ func (c *client) cmdConnect(ctx context.Context) error {
 		c.conn.SetDeadline(deadline)
 	}
 
-	if err := c.sendPacket(msg); err != nil {
+	raw, err := encodePacket(msg)
+	if err != nil {
 		return err
 	}
 
-	pkt, errRead := packet.ReadPacket(c.conn)
+	// writeLoop is not started until connected
+	if err := c.writePacket(c.conn, msg, raw); err != nil {
+		return wrapTimeout(err)
+	}
+	c.packetSent(msg, raw)
+
+	pkt, errRead := c.readPacket(c.conn)
 	if errRead != nil {
-		return fmt.Errorf("failed to read connack, %s", errRead)
+		return fmt.Errorf("failed to read connack, %w", wrapTimeout(errRead))
 	}
 
 	c.conn.SetDeadline(time.Time{})
 	connAck, okAck := pkt.(*packet.ConnectAck)
 	if !okAck {
-		return fmt.Errorf("not connack")
+		return &ProtocolError{"not connack"}
 	}
 
 	if connAck.ReturnCode != 0 {
-		if retMsg, ok := packet.ConnackReturnCodes[connAck.ReturnCode]; ok {
-			return errors.New(retMsg)
-		}
-
-		return fmt.Errorf("connack errcode=%d", connAck.ReturnCode)
+		return &ConnackError{connAck.ReturnCode}
 	}
 
-	log.Printf("received connack: %+v\n", connAck)
+	c.sessionPresent.Store(connAck.SessionPresent)
+	c.log(LogInfo, "connected", "session_present", connAck.SessionPresent)
 	return nil
 }
 
 // TODO: qos2 not implemented yet
 func (c *client) cmdPublish(ctx context.Context, topic string,
 	qos byte, dup bool, retained bool, payload []byte) error {
+	tok := c.cmdPublishAsync(ctx, topic, qos, dup, retained, payload)
+	if qos == 0 { // no need ack for QOS 0
+		return tok.Wait(ctx)
+	}
+
+	// It MUST send PUBACK packets in the order in which the corresponding PUBLISH packets were received (QoS 1 messages) [MQTT-4.6.0-2]
+	_, err := c.waitPubAck(ctx, tok)
+	return err
+}
+
+// cmdPublishAsync sends the PUBLISH packet, and returns a token completed by the PUBACK.
+func (c *client) cmdPublishAsync(ctx context.Context, topic string,
+	qos byte, dup bool, retained bool, payload []byte) *token {
 	msg := &packet.Publish{
 		Topic:      topic,
 		DupFlag:    dup,
 		QosLevel:   qos,
 		RetainFlag: retained,
 		Payload:    payload,
-		ID:         c.getPacketID(),
 	}
 
-	if err := c.sendPacket(msg); err != nil {
-		return fmt.Errorf("failed to publish, %s", err)
+	if err := c.limiter.wait(ctx, topic, publishSize(topic, qos, payload)); err != nil {
+		return newCompletedToken(wrapTimeout(err))
 	}
 
-	if qos == 0 { // no need ack for QOS 0
-		return nil
-	}
+	var tok *token
+	if qos == 0 {
+		tok = newToken()
+	} else {
+		id, t, err := c.inflight.acquire(ctx, packet.CtrlTypePUBACK)
+		if err != nil {
+			return newCompletedToken(wrapTimeout(err))
+		}
 
-	ack, err := c.waitPubAck(ctx, msg.ID)
-	if err != nil {
-		return err
+		msg.ID, tok = id, t
 	}
 
-	// It MUST send PUBACK packets in the order in which the corresponding PUBLISH packets were received (QoS 1 messages) [MQTT-4.6.0-2]
-	log.Printf("received puback: %+v, publish id=%d\n", ack, msg.ID)
+	if err := c.sendPacketLane(ctx, msg, publishLane(ctx)); err != nil {
+		if qos > 0 {
+			c.inflight.release(packet.CtrlTypePUBACK, msg.ID)
+		}
+		tok.complete(nil, fmt.Errorf("failed to publish, %w", err))
+		return tok
+	}
 
-	if ack.ID != msg.ID {
-		return fmt.Errorf("puback id error")
+	if qos == 0 { // no need ack for QOS 0
+		tok.complete(nil, nil)
 	}
 
-	return nil
+	return tok
 }
 
 func (c *client) cmdSubscribe(ctx context.Context, topic string, qos byte, callback MessageHandler) error {
+	return c.cmdSubscribeMultiple(ctx, map[string]byte{topic: qos}, callback)
+}
+
+func (c *client) cmdSubscribeMultiple(ctx context.Context, filters map[string]byte, callback MessageHandler) error {
+	return c.cmdSubscribeRoutes(ctx, filters, func(string) MessageHandler { return callback })
+}
+
+// cmdSubscribeRoutes subscribes filters, and registers the callback returned by callbacks for each of them.
+func (c *client) cmdSubscribeRoutes(ctx context.Context, filters map[string]byte, callbacks func(filter string) MessageHandler) error {
+	var snap map[string]route
+	register := func() map[string]byte {
+		snap = c.handler.Snapshot(slices.Collect(maps.Keys(filters))...)
+		for topic, qos := range filters {
+			c.handler.Register(topic, qos, callbacks(topic))
+		}
+		return filters
+	}
+
+	return c.subscribeRoutes(ctx, register, func(topics []string) []string {
+		return c.handler.Restore(topics, snap)
+	})
+}
+
+// subscribeRoutes sets up the routes by register, and subscribes the filters it returns.
+// If subscribing failed, undo removes the routes and returns the filters left without route,
+// they are unsubscribed if SUBSCRIBE has been sent.
+func (c *client) subscribeRoutes(ctx context.Context, register func() map[string]byte, undo func(filters []string) []string) error {
+	id, tok, err := c.inflight.acquire(ctx, packet.CtrlTypeSUBACK)
+	if err != nil {
+		return wrapTimeout(err)
+	}
+
 	msg := &packet.Subscribe{
-		ID:          c.getPacketID(),
-		TopicFilter: []string{topic},
-		QosLevel:    []byte{qos},
+		ID: id,
 	}
 
-	if err := c.sendPacket(msg); err != nil {
+	// routes are registered before sending, the messages(eg: retained ones) might arrive just after SUBACK.
+	c.subsLock.Lock()
+	for topic, qos := range register() {
+		msg.TopicFilter = append(msg.TopicFilter, topic)
+		msg.QosLevel = append(msg.QosLevel, qos)
+	}
+
+	err = c.sendPacket(msg)
+	if err != nil {
+		undo(msg.TopicFilter)
+	}
+	c.subsLock.Unlock()
+	if err != nil {
+		c.inflight.release(packet.CtrlTypeSUBACK, msg.ID)
+		return fmt.Errorf("failed to subscribe, %w", err)
+	}
+
+	if err := c.waitSubscribed(ctx, msg, tok); err != nil {
+		c.subsLock.Lock()
+		removed := undo(msg.TopicFilter)
+		c.subsLock.Unlock()
+
+		// the broker might have subscribed them already, eg: ctx is done before SUBACK arrives
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+			defer cancel()
+			if err := c.unsubscribeUnrouted(ctx, removed); err != nil {
+				c.log(LogWarn, "failed to revoke subscription", LogFieldTopic, removed, LogFieldError, err)
+			}
+		}()
 		return err
 	}
 
-	ack, err := c.waitSubAck(ctx, msg.ID)
+	return nil
+}
+
+// waitSubscribed waits the SUBACK of msg, and checks the return codes.
+func (c *client) waitSubscribed(ctx context.Context, msg *packet.Subscribe, tok *token) error {
+	ack, err := c.waitSubAck(ctx, tok)
 	if err != nil {
 		return err
 	}
 
 	if len(ack.RetCode) != len(msg.QosLevel) {
-		errors.New("return code number does not match")
+		return &ProtocolError{"return code number does not match"}
 	}
 
-	if ack.RetCode[0] != 0 { // TODO: qos1 returncode=1
-		errors.New("sub error")
+	for i, code := range ack.RetCode {
+		if code == 0x80 {
+			return &SubscribeError{msg.TopicFilter[i], code}
+		}
 	}
 
-	c.handler.Register(topic, qos, callback)
 	return nil
 }
 
 func (c *client) cmdUnsubscribe(ctx context.Context, topics ...string) error {
+	id, tok, err := c.inflight.acquire(ctx, packet.CtrlTypeUNSUBACK)
+	if err != nil {
+		return wrapTimeout(err)
+	}
+
 	msg := &packet.UnSubscribe{
-		ID:          c.getPacketID(),
+		ID:          id,
 		TopicFilter: topics,
 	}
 
 	if err := c.sendPacket(msg); err != nil {
-		return err
+		c.inflight.release(packet.CtrlTypeUNSUBACK, msg.ID)
+		return fmt.Errorf("failed to unsubscribe, %w", err)
 	}
 
-	_, err := c.waitUnsubAck(ctx, msg.ID)
+	_, err = c.waitUnsubAck(ctx, tok)
 	if err != nil {
 		return err
 	}
 
+	c.handler.Unregister(topics...)
 	return nil
 }
+
+// unsubscribeUnrouted unsubscribes the filters still having no route, the ones routed again meanwhile are kept.
+// UNSUBSCRIBE is sent under subsLock, so it won't undo a SUBSCRIBE sent after the check.
+func (c *client) unsubscribeUnrouted(ctx context.Context, filters []string) error {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	id, tok, err := c.inflight.acquire(ctx, packet.CtrlTypeUNSUBACK)
+	if err != nil {
+		return wrapTimeout(err)
+	}
+
+	c.subsLock.Lock()
+	filters = c.handler.Unrouted(filters)
+	if len(filters) > 0 {
+		err = c.sendPacket(&packet.UnSubscribe{ID: id, TopicFilter: filters})
+	}
+	c.subsLock.Unlock()
+	if len(filters) == 0 {
+		c.inflight.release(packet.CtrlTypeUNSUBACK, id)
+		return nil
+	}
+
+	if err != nil {
+		c.inflight.release(packet.CtrlTypeUNSUBACK, id)
+		return fmt.Errorf("failed to unsubscribe, %w", err)
+	}
+
+	_, err = c.waitUnsubAck(ctx, tok)
+	return err
+}
@@ -0,0 +1,81 @@
+// Package codec contains the encoding of message payloads, used by the typed publish and subscribe helpers.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec marshals values to payloads and unmarshals payloads to values.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes values with encoding/json.
+	JSON Codec = jsonCodec{}
+	// Gob encodes values with encoding/gob, each payload is a standalone gob stream.
+	Gob Codec = gobCodec{}
+	// Raw passes []byte or string through without encoding.
+	Raw Codec = rawCodec{}
+	// MsgPack encodes values with MessagePack.
+	MsgPack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case string:
+		return []byte(b), nil
+	case *[]byte:
+		return *b, nil
+	case *string:
+		return []byte(*b), nil
+	default:
+		return nil, fmt.Errorf("raw codec: unsupported type %T", v)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch b := v.(type) {
+	case *[]byte:
+		*b = append([]byte(nil), data...)
+	case *string:
+		*b = string(data)
+	default:
+		return fmt.Errorf("raw codec: unsupported type %T", v)
+	}
+
+	return nil
+}
@@ -0,0 +1,676 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// msgpackCodec is a simple MessagePack implementation, the extension types are not supported.
+//
+// Structs are encoded as maps keyed by field name, or the name in `msgpack:"name"` tag,
+// fields tagged with `msgpack:"-"` are skipped.
+type msgpackCodec struct{}
+
+var errMsgpackShortBuffer = errors.New("msgpack: unexpected end of data")
+
+// maxMsgpackDepth limits the nesting of arrays and maps, deeply nested input would exhaust the stack.
+const maxMsgpackDepth = 512
+
+var errMsgpackTooDeep = fmt.Errorf("msgpack: exceeded max depth %d", maxMsgpackDepth)
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: unmarshal to non-pointer %T", v)
+	}
+
+	d := &msgpackDecoder{buf: data}
+	val, err := d.decode()
+	if err != nil {
+		return err
+	}
+
+	if len(d.buf) != 0 {
+		return errors.New("msgpack: extra data after value")
+	}
+
+	return assign(rv.Elem(), val)
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) writeByte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *msgpackEncoder) writeUint(code byte, v uint64, size int) {
+	e.buf = append(e.buf, code)
+	switch size {
+	case 1:
+		e.buf = append(e.buf, byte(v))
+	case 2:
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+	case 4:
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+	case 8:
+		e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.encodeUint(uint64(v))
+	case v >= -32:
+		e.writeByte(byte(v)) // negative fixint
+	case v >= math.MinInt8:
+		e.writeUint(0xd0, uint64(v), 1)
+	case v >= math.MinInt16:
+		e.writeUint(0xd1, uint64(v), 2)
+	case v >= math.MinInt32:
+		e.writeUint(0xd2, uint64(v), 4)
+	default:
+		e.writeUint(0xd3, uint64(v), 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		e.writeByte(byte(v)) // positive fixint
+	case v <= math.MaxUint8:
+		e.writeUint(0xcc, v, 1)
+	case v <= math.MaxUint16:
+		e.writeUint(0xcd, v, 2)
+	case v <= math.MaxUint32:
+		e.writeUint(0xce, v, 4)
+	default:
+		e.writeUint(0xcf, v, 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := uint64(len(s))
+	switch {
+	case n < 32:
+		e.writeByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.writeUint(0xd9, n, 1)
+	case n <= math.MaxUint16:
+		e.writeUint(0xda, n, 2)
+	default:
+		e.writeUint(0xdb, n, 4)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	n := uint64(len(b))
+	switch {
+	case n <= math.MaxUint8:
+		e.writeUint(0xc4, n, 1)
+	case n <= math.MaxUint16:
+		e.writeUint(0xc5, n, 2)
+	default:
+		e.writeUint(0xc6, n, 4)
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArrayLen(n int) {
+	switch {
+	case n < 16:
+		e.writeByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xdc, uint64(n), 2)
+	default:
+		e.writeUint(0xdd, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encodeMapLen(n int) {
+	switch {
+	case n < 16:
+		e.writeByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xde, uint64(n), 2)
+	default:
+		e.writeUint(0xdf, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.writeByte(0xc0)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.writeByte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeByte(0xc3)
+		} else {
+			e.writeByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.writeUint(0xca, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.writeUint(0xcb, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.writeByte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.encodeArrayLen(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.writeByte(0xc0)
+			return nil
+		}
+		e.encodeMapLen(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		e.encodeMapLen(len(fields))
+		for _, f := range fields {
+			e.encodeString(f.name)
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+type field struct {
+	name  string
+	index int
+}
+
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("msgpack"); ok {
+			tag, _, _ = strings.Cut(tag, ",")
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+
+		fields = append(fields, field{name, i})
+	}
+
+	return fields
+}
+
+// msgpackMap keeps the entries of a decoded map in order, keys might be not comparable.
+type msgpackMap []msgpackMapEntry
+
+type msgpackMapEntry struct {
+	key, value interface{}
+}
+
+type msgpackDecoder struct {
+	buf   []byte
+	depth int // the number of arrays and maps being decoded
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if len(d.buf) < n {
+		return nil, errMsgpackShortBuffer
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// decode reads a value as nil, bool, int64, uint64, float32, float64, string, []byte, []interface{} or msgpackMap.
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	code := b[0]
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case 0xca:
+		v, err := d.readUint(4)
+		return math.Float32frombits(uint32(v)), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (code - 0xcc))
+	case 0xd0:
+		v, err := d.readUint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.readUint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.readUint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.readUint(8)
+		return int64(v), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", code)
+	}
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// enter is called before decoding the elements of an array or map, it fails if nested too deep.
+func (d *msgpackDecoder) enter() error {
+	if d.depth >= maxMsgpackDepth {
+		return errMsgpackTooDeep
+	}
+
+	d.depth++
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if n > len(d.buf) { // each element takes at least one byte
+		return nil, errMsgpackShortBuffer
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if 2*n > len(d.buf) {
+		return nil, errMsgpackShortBuffer
+	}
+
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	m := make(msgpackMap, n)
+	for i := range m {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		m[i] = msgpackMapEntry{k, v}
+	}
+
+	return m, nil
+}
+
+// generic converts the decoded value for interface{} targets, maps with string keys become map[string]interface{}.
+func generic(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case []interface{}:
+		for i := range v {
+			g, err := generic(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = g
+		}
+		return v, nil
+	case msgpackMap:
+		allString := true
+		for _, e := range v {
+			if _, ok := e.key.(string); !ok {
+				allString = false
+				break
+			}
+		}
+
+		if allString {
+			m := make(map[string]interface{}, len(v))
+			for _, e := range v {
+				g, err := generic(e.value)
+				if err != nil {
+					return nil, err
+				}
+				m[e.key.(string)] = g
+			}
+			return m, nil
+		}
+
+		m := make(map[interface{}]interface{}, len(v))
+		for _, e := range v {
+			k, err := generic(e.key)
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, fmt.Errorf("msgpack: unsupported map key type %T", k)
+			}
+			g, err := generic(e.value)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = g
+		}
+		return m, nil
+	default:
+		return v, nil
+	}
+}
+
+// assign stores the decoded value into rv.
+func assign(rv reflect.Value, val interface{}) error {
+	if val == nil {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("msgpack: cannot unmarshal %T into %s", val, rv.Type())
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return assign(rv.Elem(), val)
+	case reflect.Interface:
+		g, err := generic(val)
+		if err != nil {
+			return err
+		}
+		gv := reflect.ValueOf(g)
+		if !gv.Type().AssignableTo(rv.Type()) {
+			return mismatch()
+		}
+		rv.Set(gv)
+	case reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch v := val.(type) {
+		case int64:
+			n = v
+		case uint64:
+			if v > math.MaxInt64 {
+				return mismatch()
+			}
+			n = int64(v)
+		default:
+			return mismatch()
+		}
+		if rv.OverflowInt(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, rv.Type())
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch v := val.(type) {
+		case uint64:
+			n = v
+		case int64:
+			if v < 0 {
+				return mismatch()
+			}
+			n = uint64(v)
+		default:
+			return mismatch()
+		}
+		if rv.OverflowUint(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, rv.Type())
+		}
+		rv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		switch v := val.(type) {
+		case float32:
+			rv.SetFloat(float64(v))
+		case float64:
+			rv.SetFloat(v)
+		case int64:
+			rv.SetFloat(float64(v))
+		case uint64:
+			rv.SetFloat(float64(v))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		switch v := val.(type) {
+		case string:
+			rv.SetString(v)
+		case []byte:
+			rv.SetString(string(v))
+		default:
+			return mismatch()
+		}
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			switch v := val.(type) {
+			case []byte:
+				rv.SetBytes(v)
+				return nil
+			case string:
+				rv.SetBytes([]byte(v))
+				return nil
+			}
+		}
+		arr, ok := val.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		s := reflect.MakeSlice(rv.Type(), len(arr), len(arr))
+		for i, v := range arr {
+			if err := assign(s.Index(i), v); err != nil {
+				return err
+			}
+		}
+		rv.Set(s)
+	case reflect.Array:
+		arr, ok := val.([]interface{})
+		if !ok || len(arr) != rv.Len() {
+			return mismatch()
+		}
+		for i, v := range arr {
+			if err := assign(rv.Index(i), v); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := val.(msgpackMap)
+		if !ok {
+			return mismatch()
+		}
+		out := reflect.MakeMapWithSize(rv.Type(), len(m))
+		for _, e := range m {
+			k := reflect.New(rv.Type().Key()).Elem()
+			if err := assign(k, e.key); err != nil {
+				return err
+			}
+			v := reflect.New(rv.Type().Elem()).Elem()
+			if err := assign(v, e.value); err != nil {
+				return err
+			}
+			out.SetMapIndex(k, v)
+		}
+		rv.Set(out)
+	case reflect.Struct:
+		m, ok := val.(msgpackMap)
+		if !ok {
+			return mismatch()
+		}
+		fields := make(map[string]int)
+		for _, f := range structFields(rv.Type()) {
+			fields[f.name] = f.index
+		}
+		for _, e := range m {
+			name, ok := e.key.(string)
+			if !ok {
+				return mismatch()
+			}
+			i, ok := fields[name]
+			if !ok {
+				continue // unknown field
+			}
+			if err := assign(rv.Field(i), e.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", rv.Type())
+	}
+
+	return nil
+}
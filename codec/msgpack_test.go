@@ -0,0 +1,290 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgPackFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		value  interface{}
+		prefix []byte // the encoded bytes start with prefix
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"false", false, []byte{0xc2}},
+		{"true", true, []byte{0xc3}},
+
+		{"positive fixint 0", 0, []byte{0x00}},
+		{"positive fixint max", 127, []byte{0x7f}},
+		{"uint8 min", 128, []byte{0xcc, 0x80}},
+		{"uint8 max", 255, []byte{0xcc, 0xff}},
+		{"uint16 min", 256, []byte{0xcd, 0x01, 0x00}},
+		{"uint16 max", 65535, []byte{0xcd, 0xff, 0xff}},
+		{"uint32 min", 65536, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{"uint32 max", uint32(math.MaxUint32), []byte{0xce, 0xff, 0xff, 0xff, 0xff}},
+		{"uint64 min", uint64(math.MaxUint32 + 1), []byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{"uint64 max", uint64(math.MaxUint64), []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"negative fixint max", -1, []byte{0xff}},
+		{"negative fixint min", -32, []byte{0xe0}},
+		{"int8 max", -33, []byte{0xd0, 0xdf}},
+		{"int8 min", int8(math.MinInt8), []byte{0xd0, 0x80}},
+		{"int16 max", -129, []byte{0xd1, 0xff, 0x7f}},
+		{"int16 min", int16(math.MinInt16), []byte{0xd1, 0x80, 0x00}},
+		{"int32 max", -32769, []byte{0xd2, 0xff, 0xff, 0x7f, 0xff}},
+		{"int32 min", int32(math.MinInt32), []byte{0xd2, 0x80, 0x00, 0x00, 0x00}},
+		{"int64 max", int64(math.MinInt32 - 1), []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff}},
+		{"int64 min", int64(math.MinInt64), []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+
+		{"float32", float32(1.5), []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}},
+		{"float64", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+
+		{"fixstr empty", "", []byte{0xa0}},
+		{"fixstr max", strings.Repeat("s", 31), []byte{0xbf}},
+		{"str8 min", strings.Repeat("s", 32), []byte{0xd9, 32}},
+		{"str8 max", strings.Repeat("s", 255), []byte{0xd9, 0xff}},
+		{"str16 min", strings.Repeat("s", 256), []byte{0xda, 0x01, 0x00}},
+		{"str16 max", strings.Repeat("s", 65535), []byte{0xda, 0xff, 0xff}},
+		{"str32 min", strings.Repeat("s", 65536), []byte{0xdb, 0x00, 0x01, 0x00, 0x00}},
+
+		{"bin8 empty", []byte{}, []byte{0xc4, 0x00}},
+		{"bin8 max", make([]byte, 255), []byte{0xc4, 0xff}},
+		{"bin16 min", make([]byte, 256), []byte{0xc5, 0x01, 0x00}},
+		{"bin16 max", make([]byte, 65535), []byte{0xc5, 0xff, 0xff}},
+		{"bin32 min", make([]byte, 65536), []byte{0xc6, 0x00, 0x01, 0x00, 0x00}},
+
+		{"fixarray empty", []int{}, []byte{0x90}},
+		{"fixarray max", make([]int, 15), []byte{0x9f}},
+		{"array16 min", make([]int, 16), []byte{0xdc, 0x00, 0x10}},
+		{"array16 max", make([]int, 65535), []byte{0xdc, 0xff, 0xff}},
+		{"array32 min", make([]int, 65536), []byte{0xdd, 0x00, 0x01, 0x00, 0x00}},
+		{"array of Go array", [2]string{"a", "b"}, []byte{0x92, 0xa1, 'a', 0xa1, 'b'}},
+
+		{"fixmap empty", map[int]int{}, []byte{0x80}},
+		{"fixmap max", intMap(15), []byte{0x8f}},
+		{"map16 min", intMap(16), []byte{0xde, 0x00, 0x10}},
+		{"map16 max", intMap(65535), []byte{0xde, 0xff, 0xff}},
+		{"map32 min", intMap(65536), []byte{0xdf, 0x00, 0x01, 0x00, 0x00}},
+
+		{"nil pointer", (*int)(nil), []byte{0xc0}},
+		{"nil slice", []string(nil), []byte{0xc0}},
+		{"nil map", map[string]int(nil), []byte{0xc0}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := MsgPack.Marshal(c.value)
+			if err != nil {
+				t.Fatalf("failed to marshal, %v", err)
+			}
+
+			if !bytes.HasPrefix(data, c.prefix) {
+				t.Fatalf("expect prefix %x, got %x", c.prefix, data[:min(len(data), 16)])
+			}
+
+			if c.value == nil {
+				return
+			}
+
+			out := reflect.New(reflect.TypeOf(c.value))
+			if err := MsgPack.Unmarshal(data, out.Interface()); err != nil {
+				t.Fatalf("failed to unmarshal, %v", err)
+			}
+
+			if !reflect.DeepEqual(c.value, out.Elem().Interface()) {
+				t.Errorf("value changed after round trip")
+			}
+		})
+	}
+}
+
+func intMap(n int) map[int]int {
+	m := make(map[int]int, n)
+	for i := 0; i < n; i++ {
+		m[i] = i
+	}
+
+	return m
+}
+
+type inner struct {
+	Name string
+}
+
+type tagged struct {
+	ID       int64             `msgpack:"id"`
+	Name     string            `msgpack:"name,omitempty"`
+	Skip     string            `msgpack:"-"`
+	Untagged bool              // keyed by field name
+	Ptr      *int              `msgpack:"ptr"`
+	NilPtr   *int              `msgpack:"nil_ptr"`
+	Inner    inner             `msgpack:"inner"`
+	InnerPtr *inner            `msgpack:"inner_ptr"`
+	Tags     map[string]string `msgpack:"tags"`
+	Any      interface{}       `msgpack:"any"`
+	private  int
+}
+
+func TestMsgPackStruct(t *testing.T) {
+	n := 42
+	in := tagged{
+		ID:       -7,
+		Name:     "sensor",
+		Skip:     "skipped",
+		Untagged: true,
+		Ptr:      &n,
+		Inner:    inner{"a"},
+		InnerPtr: &inner{"b"},
+		Tags:     map[string]string{"room": "1"},
+		Any:      map[string]interface{}{"list": []interface{}{int64(1), "two", nil}},
+		private:  1,
+	}
+
+	data, err := MsgPack.Marshal(&in)
+	if err != nil {
+		t.Fatalf("failed to marshal, %v", err)
+	}
+
+	for _, key := range []string{"id", "name", "Untagged", "nil_ptr"} {
+		if !bytes.Contains(data, []byte(key)) {
+			t.Errorf("key %s not encoded", key)
+		}
+	}
+	for _, key := range []string{"Skip", "skipped", "private"} {
+		if bytes.Contains(data, []byte(key)) {
+			t.Errorf("%s should be skipped", key)
+		}
+	}
+
+	out := tagged{NilPtr: new(int)}
+	if err := MsgPack.Unmarshal(data, &out); err != nil {
+		t.Fatalf("failed to unmarshal, %v", err)
+	}
+
+	in.Skip, in.private = "", 0
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("struct changed after round trip, %+v != %+v", out, in)
+	}
+}
+
+func TestMsgPackGeneric(t *testing.T) {
+	data, err := MsgPack.Marshal(map[string]interface{}{
+		"int":   1,
+		"uint":  uint64(math.MaxUint64),
+		"float": 1.5,
+		"bytes": []byte("b"),
+		"map":   map[int]string{1: "a"},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal, %v", err)
+	}
+
+	var out interface{}
+	if err := MsgPack.Unmarshal(data, &out); err != nil {
+		t.Fatalf("failed to unmarshal, %v", err)
+	}
+
+	expect := map[string]interface{}{
+		"int":   int64(1),
+		"uint":  uint64(math.MaxUint64),
+		"float": 1.5,
+		"bytes": []byte("b"),
+		"map":   map[interface{}]interface{}{int64(1): "a"},
+	}
+	if !reflect.DeepEqual(expect, out) {
+		t.Errorf("expect %#v, got %#v", expect, out)
+	}
+}
+
+func TestMsgPackUnmarshalError(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		out  interface{}
+	}{
+		{"empty", nil, new(int)},
+		{"extra data", []byte{0x01, 0x02}, new(int)},
+		{"unsupported format", []byte{0xc1}, new(int)},
+		{"ext type", []byte{0xd4, 0x01, 0x00}, new(int)},
+		{"int overflow", []byte{0xcd, 0x01, 0x00}, new(int8)},
+		{"negative to uint", []byte{0xff}, new(uint)},
+		{"uint64 to int", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, new(int64)},
+		{"string to int", []byte{0xa1, 'a'}, new(int)},
+		{"int to string", []byte{0x01}, new(string)},
+		{"map to slice", []byte{0x80}, new([]int)},
+		{"array length", []byte{0x92, 0x01, 0x02}, new([3]int)},
+		{"array to struct", []byte{0x90}, new(inner)},
+		{"int map key", []byte{0x81, 0x01, 0x01}, new(inner)},
+		{"slice map key", []byte{0x81, 0x90, 0x01}, new(interface{})},
+		{"huge array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, new([]int)},
+		{"huge map", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}, new(map[int]int)},
+		{"huge str", []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, new(string)},
+		{"huge bin", []byte{0xc6, 0xff, 0xff, 0xff, 0xff}, new([]byte)},
+		{"non-pointer", []byte{0x01}, 0},
+		{"nil pointer", []byte{0x01}, (*int)(nil)},
+	}
+
+	for _, c := range cases {
+		if err := MsgPack.Unmarshal(c.data, c.out); err == nil {
+			t.Errorf("%s: no error unmarshaling %x", c.name, c.data)
+		}
+	}
+}
+
+func TestMsgPackTruncated(t *testing.T) {
+	n := 1
+	data, err := MsgPack.Marshal(tagged{
+		ID:       math.MinInt64,
+		Name:     strings.Repeat("s", 300),
+		Ptr:      &n,
+		InnerPtr: &inner{"b"},
+		Tags:     map[string]string{"a": "b"},
+		Any:      []interface{}{1.5, float32(2.5), uint64(math.MaxUint64), []byte("bin"), true},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal, %v", err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		var out tagged
+		if err := MsgPack.Unmarshal(data[:i], &out); err == nil {
+			t.Errorf("no error unmarshaling %d of %d bytes", i, len(data))
+		}
+	}
+}
+
+func TestMsgPackUnsupportedType(t *testing.T) {
+	for _, v := range []interface{}{make(chan int), func() {}, complex(1, 2)} {
+		if _, err := MsgPack.Marshal(v); err == nil {
+			t.Errorf("no error marshaling %T", v)
+		}
+	}
+}
+
+func TestMsgPackDepth(t *testing.T) {
+	nested := func(prefix []byte, depth int) []byte {
+		return append(bytes.Repeat(prefix, depth), 0x00)
+	}
+
+	deep := nested([]byte{0x91}, 2<<20)
+	if err := MsgPack.Unmarshal(deep, new(interface{})); !errors.Is(err, errMsgpackTooDeep) {
+		t.Errorf("expect errMsgpackTooDeep for nested arrays, got %v", err)
+	}
+
+	if err := MsgPack.Unmarshal(nested([]byte{0x81, 0x00}, 2<<20), new(interface{})); !errors.Is(err, errMsgpackTooDeep) {
+		t.Errorf("expect errMsgpackTooDeep for nested maps, got %v", err)
+	}
+
+	if err := MsgPack.Unmarshal(nested([]byte{0x91}, maxMsgpackDepth+1), new(interface{})); !errors.Is(err, errMsgpackTooDeep) {
+		t.Errorf("expect errMsgpackTooDeep above the max depth, got %v", err)
+	}
+
+	var out interface{}
+	if err := MsgPack.Unmarshal(nested([]byte{0x91}, maxMsgpackDepth), &out); err != nil {
+		t.Errorf("failed to unmarshal at the max depth, %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package mqtt
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// compressionEnvelope marks the compressed payloads, the field is one byte Compressor ID.
+// Payloads without it are delivered as is, so compressing and plain publishers could share topics.
+var compressionEnvelope = payloadEnvelope{"compression", []byte{0x00, 'Z'}, 1}
+
+const (
+	// compressionIdentity is the ID of payloads not compressed but starting with the magic.
+	compressionIdentity = byte(0)
+
+	defaultMaxDecompressedSize = 16 << 20
+)
+
+// ErrDecompressedTooLarge passed to Compression.OnError when a payload exceeds MaxDecompressedSize after decompressed.
+var ErrDecompressedTooLarge = errors.New("decompressed payload too large")
+
+// Compressor compresses payloads, the ID is written in the payload header to select the
+// Compressor on receive, 0 is reserved.
+type Compressor interface {
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	// NewReader returns the reader decompressing r, it's read up to Compression.MaxDecompressedSize.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	// Gzip compresses payloads with compress/gzip, ID is 1.
+	Gzip Compressor = gzipCompressor{}
+	// Deflate compresses payloads with compress/flate, ID is 2.
+	Deflate Compressor = deflateCompressor{}
+)
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() byte { return 1 }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) ID() byte { return 2 }
+
+func (deflateCompressor) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// Compression is a PayloadCodec compressing outgoing payloads and decompressing incoming payloads.
+type Compression struct {
+	// Compressor used on publish, nil means Gzip.
+	Compressor Compressor
+	// Threshold is the minimum payload size to compress, smaller payloads are sent as is.
+	Threshold int
+	// Decompressors are the extra Compressors accepted on receive, Gzip and Deflate are always accepted.
+	Decompressors []Compressor
+	// MaxDecompressedSize is the max payload size after decompressed, larger ones are dropped. 0 means 16MB.
+	MaxDecompressedSize int
+	// OnError is called with the messages failed to decompress, which are dropped. nil means logging.
+	OnError func(Message, error)
+}
+
+// Interceptor returns the PublishInterceptor compressing payloads.
+func (c *Compression) Interceptor() PublishInterceptor {
+	compressor := c.Compressor
+	if compressor == nil {
+		compressor = Gzip
+	}
+
+	return payloadInterceptor(func(p *Publication) ([]byte, error) {
+		payload, err := c.compress(compressor, p.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress payload, %w", err)
+		}
+
+		return payload, nil
+	})
+}
+
+func (c *Compression) compress(compressor Compressor, payload []byte) ([]byte, error) {
+	if len(payload) >= c.Threshold {
+		compressed, err := compressor.Compress(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		header := compressionEnvelope.header(string([]byte{compressor.ID()}), len(compressed))
+		if len(header)+len(compressed) < len(payload) {
+			return append(header, compressed...), nil
+		}
+	}
+
+	if compressionEnvelope.is(payload) { // avoid being taken as compressed
+		header := compressionEnvelope.header(string([]byte{compressionIdentity}), len(payload))
+		return append(header, payload...), nil
+	}
+
+	return payload, nil
+}
+
+// Middleware returns the Middleware decompressing payloads.
+func (c *Compression) Middleware() Middleware {
+	compressors := map[byte]Compressor{
+		Gzip.ID():    Gzip,
+		Deflate.ID(): Deflate,
+	}
+	if c.Compressor != nil {
+		compressors[c.Compressor.ID()] = c.Compressor
+	}
+	for _, d := range c.Decompressors {
+		compressors[d.ID()] = d
+	}
+
+	maxSize := c.MaxDecompressedSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+
+	return payloadMiddleware(func(msg Message) ([]byte, error) {
+		payload := msg.Payload()
+		if !compressionEnvelope.is(payload) {
+			return payload, nil
+		}
+
+		_, field, data, err := compressionEnvelope.parse(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(field) != 1 {
+			return nil, fmt.Errorf("invalid compressor ID %q", field)
+		}
+
+		if field[0] == compressionIdentity {
+			return data, nil
+		}
+
+		compressor, ok := compressors[field[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown compressor %d", field[0])
+		}
+
+		decompressed, err := decompress(compressor, data, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload, %w", err)
+		}
+
+		return decompressed, nil
+	}, c.OnError)
+}
+
+// decompress reads at most max+1 bytes, so a small payload could not be inflated unbounded.
+func decompress(compressor Compressor, data []byte, max int) ([]byte, error) {
+	r, err := compressor.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decompressed) > max {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	"context"
+	"time"
+)
+
+// ContextHandler is a MessageHandler receiving a context, which is cancelled on Disconnect
+// and carries the MessageInfo of the message.
+type ContextHandler func(ctx context.Context, msg Message)
+
+// HandleContext adapts h to a MessageHandler, so it could be used in Subscribe, SubscribeMultiple and SetRoute.
+func HandleContext(h ContextHandler) MessageHandler {
+	return func(msg Message) {
+		h(MessageContext(msg), msg)
+	}
+}
+
+// MessageInfo is the per-message values carried by the context of ContextHandler.
+type MessageInfo struct {
+	Topic      string
+	PacketID   uint16 // 0 for QoS 0 messages
+	Qos        byte
+	Retained   bool
+	ReceivedAt time.Time
+}
+
+type messageInfoKey struct{}
+
+// MessageInfoFromContext returns the MessageInfo of the message being handled.
+func MessageInfoFromContext(ctx context.Context) (MessageInfo, bool) {
+	info, ok := ctx.Value(messageInfoKey{}).(MessageInfo)
+	return info, ok
+}
+
+// MessageContext returns the context of message received by client, messages wrapped by middlewares
+// should implement Context() or Unwrap() to keep it. context.Background() is returned if not found.
+func MessageContext(msg Message) context.Context {
+	for msg != nil {
+		switch m := msg.(type) {
+		case interface{ Context() context.Context }:
+			return m.Context()
+		case interface{ Unwrap() Message }:
+			msg = m.Unwrap()
+		default:
+			return context.Background()
+		}
+	}
+
+	return context.Background()
+}
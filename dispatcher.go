@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// OverflowPolicy decides what to do when the dispatch queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for space in the queue, reading from the connection is paused.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the incoming message.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest message in the queue to make room.
+	OverflowDropOldest
+)
+
+const defaultDispatchQueueSize = 64
+
+// dispatcher runs handlers in a pool of workers, messages with the same key are
+// always handled by the same worker, so their order is preserved.
+type dispatcher struct {
+	queues []chan Message
+	handle MessageHandler
+	key    func(Message) string
+	hash   func(key string) uint32 // selects the worker of key
+	policy OverflowPolicy
+	wg     *sync.WaitGroup
+	logger Logger
+}
+
+func newDispatcher(options *Options, handle MessageHandler, wg *sync.WaitGroup, logger Logger) *dispatcher {
+	size := options.DispatchQueueSize
+	if size <= 0 {
+		size = defaultDispatchQueueSize
+	}
+
+	key := options.DispatchKey
+	if key == nil {
+		key = Message.Topic
+	}
+
+	d := &dispatcher{
+		queues: make([]chan Message, options.DispatchWorkers),
+		handle: handle,
+		key:    key,
+		hash:   fnvHash,
+		policy: options.DispatchOverflow,
+		wg:     wg,
+		logger: logger,
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan Message, size)
+	}
+
+	return d
+}
+
+func (d *dispatcher) start() {
+	d.wg.Add(len(d.queues))
+	for _, q := range d.queues {
+		go d.work(q)
+	}
+}
+
+// stop closes the queues, workers exit after the queued messages handled.
+func (d *dispatcher) stop() {
+	for _, q := range d.queues {
+		close(q)
+	}
+}
+
+func (d *dispatcher) work(q chan Message) {
+	defer d.wg.Done()
+	for msg := range q {
+		d.handle(msg)
+	}
+}
+
+// dispatch queues the message to its worker, exitChan unblocks the waiting of OverflowBlock.
+func (d *dispatcher) dispatch(msg Message, exitChan <-chan struct{}) {
+	q := d.queues[d.hash(d.key(msg))%uint32(len(d.queues))]
+
+	switch d.policy {
+	case OverflowDropNewest:
+		select {
+		case q <- msg:
+		default:
+			d.logger.Log(LogWarn, "dispatch queue full, drop message", LogFieldTopic, msg.Topic())
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q <- msg:
+				return
+			default:
+			}
+
+			select {
+			case old := <-q:
+				d.logger.Log(LogWarn, "dispatch queue full, drop message", LogFieldTopic, old.Topic())
+			default:
+			}
+		}
+	default:
+		select {
+		case q <- msg:
+		case <-exitChan:
+		}
+	}
+}
+
+func fnvHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLogger = LoggerFunc(func(LogLevel, string, ...any) {})
+
+// testHash places the keys on the workers by their index in keys.
+func testHash(keys ...string) func(string) uint32 {
+	return func(key string) uint32 {
+		for i, k := range keys {
+			if k == key {
+				return uint32(i)
+			}
+		}
+
+		panic("unknown key " + key)
+	}
+}
+
+func TestConcurrentDispatch(t *testing.T) {
+	slowStarted := make(chan struct{})
+	slowRelease := make(chan struct{})
+	fastReceived := make(chan string, 20)
+	var wg sync.WaitGroup
+	d := newDispatcher(&Options{DispatchWorkers: 4}, func(msg Message) {
+		switch msg.Topic() {
+		case "dispatch/slow":
+			close(slowStarted)
+			<-slowRelease
+		case "dispatch/fast":
+			fastReceived <- string(msg.Payload())
+		}
+	}, &wg, discardLogger)
+	d.hash = testHash("dispatch/slow", "dispatch/fast")
+	d.start()
+	defer wg.Wait()
+	defer d.stop()
+	defer close(slowRelease)
+
+	exitChan := make(chan struct{})
+	d.dispatch(&message{topic: "dispatch/slow", payload: []byte("slow")}, exitChan)
+	<-slowStarted
+
+	for i := 0; i < cap(fastReceived); i++ {
+		d.dispatch(&message{topic: "dispatch/fast", payload: []byte(strconv.Itoa(i))}, exitChan)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < cap(fastReceived); i++ {
+		select {
+		case payload := <-fastReceived:
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("message out of order, expect %d, got %s", i, payload)
+			}
+		case <-timeout:
+			t.Fatalf("fast topic blocked by slow handler")
+		}
+	}
+}
+
+func TestDispatchOverflow(t *testing.T) {
+	cases := []struct {
+		policy OverflowPolicy
+		expect []string
+	}{
+		{OverflowDropNewest, []string{"0", "1"}},
+		{OverflowDropOldest, []string{"2", "3"}},
+	}
+
+	for _, c := range cases {
+		release := make(chan struct{})
+		var received []string
+		var wg sync.WaitGroup
+		d := newDispatcher(&Options{DispatchWorkers: 1, DispatchQueueSize: 2, DispatchOverflow: c.policy}, func(msg Message) {
+			<-release
+			received = append(received, string(msg.Payload()))
+		}, &wg, discardLogger)
+
+		// dispatch before the worker started, so the queue keeps the first two messages
+		for i := 0; i < 4; i++ {
+			d.dispatch(&message{topic: "a", payload: []byte(strconv.Itoa(i))}, nil)
+		}
+
+		d.start()
+		close(release)
+		d.stop()
+		wg.Wait()
+		if !slices.Equal(received, c.expect) {
+			t.Errorf("policy %d, expect %v, got %v", c.policy, c.expect, received)
+		}
+	}
+}
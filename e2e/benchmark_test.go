@@ -0,0 +1,45 @@
+package e2e_test
+
+import (
+	"context"
+	"testing"
+
+	mqtt "github.com/openim/mqtt-client"
+)
+
+// BenchmarkPublishQos0 compares the write buffer configurations with concurrent publishers of small messages,
+// coalescing writes the packets queued together in one syscall.
+func BenchmarkPublishQos0(b *testing.B) {
+	configs := []struct {
+		name            string
+		writeBufferSize int
+	}{
+		{"unbuffered", -1},
+		{"coalesced-4k", 0},
+		{"coalesced-64k", 64 * 1024},
+	}
+
+	for _, cfg := range configs {
+		b.Run(cfg.name, func(b *testing.B) {
+			servers, cleanFn := MustGetMqttServers(b)
+			defer cleanFn()
+
+			c := mustConnect(b, servers, &mqtt.Options{ClientID: "bench", WriteBufferSize: cfg.writeBufferSize})
+			defer c.Disconnect()
+
+			payload := []byte("temperature=21.5")
+			ctx := context.Background()
+			b.SetBytes(int64(len(payload)))
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := c.Publish(ctx, "bench/qos0", 0, false, payload); err != nil {
+						b.Errorf("failed to publish, %s", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -2,16 +2,27 @@
 package e2e_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	mqtt "github.com/openim/mqtt-client"
 	"github.com/openim/mqtt-client/mqtttest"
+	"github.com/openim/mqtt-client/packet"
 )
 
 // all test use intenal test server or external server if configed.
@@ -21,7 +32,7 @@ import (
 // eg: MQTT_TEST_SERVERS = "tcp://127.0.0.1:1083,tcp://127.0.0.1:1084"
 const EnvMqttTestServers = "MQTT_TEST_SERVERS"
 
-func MustGetMqttServers(t *testing.T) (servers []*url.URL, cleanFn func()) {
+func MustGetMqttServers(t testing.TB) (servers []*url.URL, cleanFn func()) {
 	env := os.Getenv(EnvMqttTestServers)
 	ss := strings.Split(env, ",")
 	for _, s := range ss {
@@ -49,23 +60,22 @@ func MustGetMqttServers(t *testing.T) (servers []*url.URL, cleanFn func()) {
 	return
 }
 
-func MustConnectServer(t *testing.T, clientOpt *mqtt.Options) (c mqtt.Client, cleanFn func()) {
+// MustConnectServer connects a client with opt to a new server, nil opt means the defaults.
+func MustConnectServer(t testing.TB, opt *mqtt.Options) (c mqtt.Client, cleanFn func()) {
 	servers, servCleanfn := MustGetMqttServers(t)
-
-	opt := mqtt.Options{
-		Servers:      servers,
-		ClientID:     "e2e test client",
-		KeepAlive:    time.Second * 5,
-		CleanSession: true,
+	if opt == nil {
+		opt = &mqtt.Options{}
 	}
-
-	if clientOpt != nil {
-		if clientOpt.KeepAlive != 0 {
-			opt.KeepAlive = clientOpt.KeepAlive
-		}
+	if opt.ClientID == "" {
+		opt.ClientID = "e2e test client"
 	}
+	if opt.KeepAlive == 0 {
+		opt.KeepAlive = time.Second * 5
+	}
+	opt.Servers = servers
+	opt.CleanSession = true
 
-	c = mqtt.NewClient(opt)
+	c = mqtt.NewClient(*opt)
 	cleanFn = func() {
 		if err := c.Disconnect(); err != nil {
 			log.Printf("client disconnect error, %s", err)
@@ -83,6 +93,21 @@ func MustConnectServer(t *testing.T, clientOpt *mqtt.Options) (c mqtt.Client, cl
 	return
 }
 
+// mustConnect connects a new client with opt to servers.
+func mustConnect(t testing.TB, servers []*url.URL, opt *mqtt.Options) mqtt.Client {
+	opt.Servers = servers
+	opt.KeepAlive = time.Second * 5
+	opt.CleanSession = true
+	c := mqtt.NewClient(*opt)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("failed to connect, %s", err)
+	}
+
+	return c
+}
+
 func TestKeepalive(t *testing.T) {
 	if testing.Short() {
 		return
@@ -97,3 +122,719 @@ func TestKeepalive(t *testing.T) {
 		t.Errorf("keepalive failed")
 	}
 }
+
+func TestMaxInflight(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{MaxInflight: 2})
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var tokens []mqtt.Token
+	for i := 0; i < 100; i++ {
+		tokens = append(tokens, c.PublishAsync(ctx, "test_topic", 1, false, []byte("hello")))
+	}
+
+	for _, tok := range tokens {
+		if err := tok.Wait(ctx); err != nil {
+			t.Errorf("failed to publish, %s", err)
+		}
+	}
+}
+
+// silentServer accepts clients and never responds after CONNACK, the received packets are handed to the test.
+type silentServer struct {
+	listener  net.Listener
+	conns     chan net.Conn
+	publishes chan *packet.Publish
+	packets   chan packet.ControlPacket // packets other than PUBLISH
+}
+
+func startSilentServer(t testing.TB) *silentServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, %s", err)
+	}
+
+	s := &silentServer{
+		listener:  listener,
+		conns:     make(chan net.Conn, 1),
+		publishes: make(chan *packet.Publish, 1024),
+		packets:   make(chan packet.ControlPacket, 16),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			t.Cleanup(func() { conn.Close() })
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *silentServer) serve(conn net.Conn) {
+	if _, err := packet.ReadPacket(conn); err != nil {
+		return
+	}
+
+	if err := (&packet.ConnectAck{}).Write(conn); err != nil {
+		return
+	}
+
+	s.conns <- conn
+	for {
+		pkt, err := packet.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		if pub, ok := pkt.(*packet.Publish); ok {
+			s.publishes <- pub
+		} else {
+			s.packets <- pkt
+		}
+	}
+}
+
+func (s *silentServer) endpoint() *url.URL {
+	return &url.URL{Scheme: "tcp", Host: s.listener.Addr().String()}
+}
+
+// received waits for n PUBLISH packets.
+func (s *silentServer) received(t testing.TB, n int) []*packet.Publish {
+	var pubs []*packet.Publish
+	timeout := time.After(2 * time.Second)
+	for len(pubs) < n {
+		select {
+		case pub := <-s.publishes:
+			pubs = append(pubs, pub)
+		case <-timeout:
+			t.Fatalf("expect %d publishes, got %d", n, len(pubs))
+		}
+	}
+
+	return pubs
+}
+
+func TestPendingFailOnDisconnect(t *testing.T) {
+	s := startSilentServer(t)
+	c := mustConnect(t, []*url.URL{s.endpoint()}, &mqtt.Options{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var tokens []mqtt.Token
+	for i := 0; i < 100; i++ {
+		tokens = append(tokens, c.PublishAsync(ctx, "test_topic", 1, false, []byte("hello")))
+	}
+	s.received(t, len(tokens))
+
+	start := time.Now()
+	c.Disconnect()
+	for _, tok := range tokens {
+		if err := tok.Wait(ctx); !errors.Is(err, mqtt.ErrDisconnected) {
+			t.Fatalf("expect ErrDisconnected, got %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("pending publishes completed after %s", elapsed)
+	}
+}
+
+func TestCancelledWaiterReleasesID(t *testing.T) {
+	s := startSilentServer(t)
+	c := mustConnect(t, []*url.URL{s.endpoint()}, &mqtt.Options{MaxInflight: 1})
+	defer c.Disconnect()
+	conn := <-s.conns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Publish(ctx, "test_topic", 1, false, []byte("cancelled")); !errors.Is(err, mqtt.ErrTimeout) {
+		t.Fatalf("expect ErrTimeout, got %v", err)
+	}
+	late := s.received(t, 1)[0]
+
+	// the window has one slot only, the next publish blocks if the cancelled one still holds it
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tok := c.PublishAsync(ctx, "test_topic", 1, false, []byte("next"))
+	next := s.received(t, 1)[0]
+	if next.ID == late.ID {
+		t.Fatalf("packet id %d is reused before its late ack", late.ID)
+	}
+
+	// the late ack is dropped, incomingLoop must go on reading the ack of the next publish
+	if err := (&packet.PubAck{ID: late.ID}).Write(conn); err != nil {
+		t.Fatalf("failed to write late PUBACK, %s", err)
+	}
+	select {
+	case <-tok.Done():
+		t.Fatalf("the late ack completes another publish")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := (&packet.PubAck{ID: next.ID}).Write(conn); err != nil {
+		t.Fatalf("failed to write PUBACK, %s", err)
+	}
+	if err := tok.Wait(ctx); err != nil {
+		t.Errorf("failed to publish after the cancelled one, %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	servers, cleanFn := MustGetMqttServers(t)
+	defer cleanFn()
+	c := mustConnect(t, servers, &mqtt.Options{ClientID: "e2e reconnect"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := c.Publish(ctx, "reconnect/state", 1, true, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("failed to publish after %d reconnects, %s", i, err)
+		}
+
+		msg, err := c.GetOnce(ctx, "reconnect/state")
+		if err != nil || string(msg.Payload()) != strconv.Itoa(i) {
+			t.Fatalf("failed to get message after %d reconnects, %v", i, err)
+		}
+
+		c.Disconnect()
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("failed to reconnect, %s", err)
+		}
+	}
+
+	if err := c.ClearRetained(ctx, "reconnect/state"); err != nil {
+		t.Errorf("failed to clear retained, %s", err)
+	}
+	c.Disconnect()
+}
+
+func TestNotConnectedError(t *testing.T) {
+	c := mqtt.NewClient(mqtt.Options{ClientID: "e2e test client"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.Publish(ctx, "test_topic", 1, false, []byte("hello")); !errors.Is(err, mqtt.ErrNotConnected) {
+		t.Errorf("expect ErrNotConnected, got %v", err)
+	}
+
+	if err := c.Subscribe(ctx, "test_topic", 1, nil); !errors.Is(err, mqtt.ErrNotConnected) {
+		t.Errorf("expect ErrNotConnected, got %v", err)
+	}
+
+	if err := c.Disconnect(); !errors.Is(err, mqtt.ErrNotConnected) {
+		t.Errorf("expect ErrNotConnected, got %v", err)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	errForbidden := errors.New("forbidden topic")
+	errAudit := errors.New("audit failed")
+	reject := func(next mqtt.PublishFunc) mqtt.PublishFunc {
+		return func(ctx context.Context, p *mqtt.Publication) error {
+			if strings.HasSuffix(p.Topic, "/forbidden") {
+				return errForbidden
+			}
+
+			if err := next(ctx, p); err != nil {
+				return err
+			}
+
+			if strings.HasSuffix(p.Topic, "/unaudited") {
+				return errAudit
+			}
+			return nil
+		}
+	}
+
+	panics := make(chan interface{}, 1)
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{
+		Middlewares: []mqtt.Middleware{mqtt.Recover(func(msg mqtt.Message, v interface{}) {
+			panics <- v
+		})},
+		PublishInterceptors: []mqtt.PublishInterceptor{mqtt.TopicPrefix("tenant1/"), reject},
+	})
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan mqtt.Message, 1)
+	err := c.Subscribe(ctx, "tenant1/#", 1, func(msg mqtt.Message) {
+		received <- msg
+		panic("handler failed")
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	if err := c.Publish(ctx, "forbidden", 1, false, []byte("hello")); err != errForbidden {
+		t.Errorf("expect publish rejected, got %v", err)
+	}
+
+	if err := c.PublishAsync(ctx, "forbidden", 1, false, []byte("hello")).Wait(ctx); err != errForbidden {
+		t.Errorf("expect async publish rejected, got %v", err)
+	}
+
+	if err := c.Publish(ctx, "data", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	select {
+	case msg := <-received:
+		if msg.Topic() != "tenant1/data" {
+			t.Errorf("topic prefix not added, %s", msg.Topic())
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+
+	select {
+	case <-panics:
+	case <-ctx.Done():
+		t.Errorf("panic not recovered")
+	}
+
+	if err := c.PublishAsync(ctx, "unaudited", 0, false, []byte("hello")).Wait(ctx); err != errAudit {
+		t.Errorf("expect error of interceptor after sent, got %v", err)
+	}
+}
+
+func TestContextHandler(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, nil)
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	handlerCtxs := make(chan context.Context, 1)
+	err := c.Subscribe(ctx, "context/#", 1, mqtt.HandleContext(func(ctx context.Context, msg mqtt.Message) {
+		handlerCtxs <- ctx
+	}))
+	if err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	if err := c.Publish(ctx, "context/a", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	var handlerCtx context.Context
+	select {
+	case handlerCtx = <-handlerCtxs:
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+
+	info, ok := mqtt.MessageInfoFromContext(handlerCtx)
+	if !ok || info.Topic != "context/a" || info.Qos != 1 || info.PacketID == 0 {
+		t.Errorf("unexpected message info, %+v", info)
+	}
+
+	if handlerCtx.Err() != nil {
+		t.Errorf("handler context cancelled before disconnect")
+	}
+
+	c.Disconnect()
+	if handlerCtx.Err() == nil {
+		t.Errorf("handler context not cancelled after disconnect")
+	}
+}
+
+func TestSubscribeTimeoutUnsubscribes(t *testing.T) {
+	s := startSilentServer(t)
+	c := mustConnect(t, []*url.URL{s.endpoint()}, &mqtt.Options{})
+	defer c.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Subscribe(ctx, "timeout/a", 1, func(mqtt.Message) {}); !errors.Is(err, mqtt.ErrTimeout) {
+		t.Fatalf("expect ErrTimeout, got %v", err)
+	}
+
+	select {
+	case pkt := <-s.packets:
+		if _, ok := pkt.(*packet.Subscribe); !ok {
+			t.Fatalf("expect SUBSCRIBE, got %T", pkt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("SUBSCRIBE not received")
+	}
+
+	select {
+	case pkt := <-s.packets:
+		unsub, ok := pkt.(*packet.UnSubscribe)
+		if !ok || !reflect.DeepEqual(unsub.TopicFilter, []string{"timeout/a"}) {
+			t.Errorf("expect UNSUBSCRIBE of timeout/a, got %+v", pkt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("UNSUBSCRIBE not received after the timeout")
+	}
+}
+
+func TestDisconnectAfterConnectionLost(t *testing.T) {
+	s := startSilentServer(t)
+	c := mustConnect(t, []*url.URL{s.endpoint()}, &mqtt.Options{DispatchWorkers: 1})
+	conn := <-s.conns
+
+	handling := make(chan struct{})
+	handled := make(chan struct{})
+	c.SetRoute("context/a", mqtt.HandleContext(func(ctx context.Context, msg mqtt.Message) {
+		close(handling)
+		<-ctx.Done()
+		close(handled)
+	}))
+
+	if err := (&packet.Publish{Topic: "context/a", Payload: []byte("hello")}).Write(conn); err != nil {
+		t.Fatalf("failed to write PUBLISH, %s", err)
+	}
+	<-handling
+	conn.Close()
+
+	for start := time.Now(); c.IsConnected(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("connection loss not detected")
+		}
+	}
+
+	if err := c.Disconnect(); !errors.Is(err, mqtt.ErrNotConnected) {
+		t.Errorf("expect ErrNotConnected, got %v", err)
+	}
+
+	select {
+	case <-handled:
+	default:
+		t.Errorf("handler still running after disconnect")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, nil)
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := c.Subscribe(ctx, "svc/upper", 1, mqtt.Responder(c, func(ctx context.Context, req mqtt.Message) ([]byte, error) {
+		if string(req.Payload()) == "fail" {
+			return nil, errors.New("bad request")
+		}
+
+		return bytes.ToUpper(req.Payload()), nil
+	}))
+	if err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Request(ctx, "svc/upper", []byte("hello"))
+		if err != nil {
+			t.Fatalf("request failed, %s", err)
+		}
+
+		if string(resp) != "HELLO" {
+			t.Errorf("unexpected response, %s", resp)
+		}
+	}
+
+	_, err = c.Request(ctx, "svc/upper", []byte("fail"))
+	var respErr *mqtt.ResponseError
+	if !errors.As(err, &respErr) || respErr.Message != "bad request" {
+		t.Errorf("unexpected error, %v", err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := c.Request(timeoutCtx, "svc/nobody", []byte("hello")); !errors.Is(err, mqtt.ErrTimeout) {
+		t.Errorf("expect timeout, got %v", err)
+	}
+}
+
+func TestResponderWithFullWindow(t *testing.T) {
+	s := startSilentServer(t)
+	c := mustConnect(t, []*url.URL{s.endpoint()}, &mqtt.Options{MaxInflight: 1})
+	defer c.Disconnect()
+	conn := <-s.conns
+
+	// the handler runs inline, the response waits for the window without blocking the read loop
+	c.SetRoute("svc/echo", mqtt.Responder(c, func(ctx context.Context, req mqtt.Message) ([]byte, error) {
+		return req.Payload(), nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fill := c.PublishAsync(ctx, "fill", 1, false, []byte("fill"))
+	pending := s.received(t, 1)[0]
+
+	header := []byte(`{"reply_to":"reply/1","correlation_id":"1"}`)
+	req := binary.BigEndian.AppendUint16(nil, uint16(len(header)))
+	req = append(append(req, header...), "hello"...)
+	if err := (&packet.Publish{Topic: "svc/echo", Payload: req}).Write(conn); err != nil {
+		t.Fatalf("failed to write request, %s", err)
+	}
+	if err := (&packet.PubAck{ID: pending.ID}).Write(conn); err != nil {
+		t.Fatalf("failed to write PUBACK, %s", err)
+	}
+
+	if err := fill.Wait(ctx); err != nil {
+		t.Fatalf("PUBACK not handled while the response is waiting, %v", err)
+	}
+
+	resp := s.received(t, 1)[0]
+	if resp.Topic != "reply/1" || !bytes.HasSuffix(resp.Payload, []byte("hello")) {
+		t.Errorf("unexpected response, %s %q", resp.Topic, resp.Payload)
+	}
+}
+
+func TestRequestWithTopicPrefix(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{
+		PublishInterceptors: []mqtt.PublishInterceptor{mqtt.TopicPrefix("tenant1/")},
+	})
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := c.Subscribe(ctx, "tenant1/svc/echo", 1, mqtt.Responder(c, func(ctx context.Context, req mqtt.Message) ([]byte, error) {
+		return req.Payload(), nil
+	}))
+	if err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	resp, err := c.Request(ctx, "svc/echo", []byte("hello"))
+	if err != nil {
+		t.Fatalf("request failed, %s", err)
+	}
+
+	if string(resp) != "hello" {
+		t.Errorf("unexpected response, %s", resp)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{Logger: mqtt.NewSlogLogger(logger)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan struct{})
+	if err := c.Subscribe(ctx, "logger/test", 1, func(msg mqtt.Message) { close(received) }); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	if err := c.Publish(ctx, "logger/test", 1, false, []byte("secret payload")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	<-received
+	cleanFn()
+
+	logs := buf.String()
+	for _, want := range []string{`"client_id":"e2e test client"`, `"packet_type":"PUBACK"`, `"msg":"connected"`, `"server":"tcp://`} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("%s not logged", want)
+		}
+	}
+
+	if strings.Contains(logs, "secret payload") {
+		t.Errorf("payload should not be logged")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := mqtt.NewPrometheusMetrics()
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{Metrics: metrics})
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan struct{})
+	if err := c.Subscribe(ctx, "metrics/test", 1, func(msg mqtt.Message) { close(received) }); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	if err := c.Publish(ctx, "metrics/test", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	<-received
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`mqtt_client_packets_sent_total{type="PUBLISH"} 1`,
+		`mqtt_client_packets_received_total{type="PUBLISH"} 1`,
+		`mqtt_client_bytes_sent_total{type="CONNECT"} `,
+		`mqtt_client_connects_total 1`,
+		`mqtt_client_reconnects_total 0`,
+		`mqtt_client_inflight 0`,
+		`mqtt_client_publish_latency_seconds_count 1`,
+		`mqtt_client_handler_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%s not found in metrics", want)
+		}
+	}
+}
+
+func TestPacketTap(t *testing.T) {
+	capture := &bytes.Buffer{}
+	pw, err := mqtt.NewPcapngWriter(capture)
+	if err != nil {
+		t.Fatalf("failed to create pcapng writer, %s", err)
+	}
+
+	var lock sync.Mutex
+	var events []mqtt.PacketEvent
+	tap := func(ev mqtt.PacketEvent) {
+		lock.Lock()
+		events = append(events, ev)
+		lock.Unlock()
+		pw.Tap(ev)
+	}
+
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{PacketTap: tap})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := c.Subscribe(ctx, "tap/test", 1, func(msg mqtt.Message) {}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	if err := c.Publish(ctx, "tap/test", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	cleanFn()
+
+	var seen []string
+	for _, ev := range events {
+		seen = append(seen, fmt.Sprintf("%s %T", ev.Direction, ev.Packet))
+		decoded, err := packet.ReadPacket(bytes.NewReader(ev.Raw))
+		if err != nil || reflect.TypeOf(decoded) != reflect.TypeOf(ev.Packet) {
+			t.Errorf("raw bytes of %T not matched, %v", ev.Packet, err)
+		}
+	}
+
+	want := []string{
+		"out *packet.Connect",
+		"in *packet.ConnectAck",
+		"out *packet.Subscribe",
+		"in *packet.SubAck",
+		"out *packet.Publish",
+		"in *packet.Publish",
+		"out *packet.PubAck",
+		"in *packet.PubAck",
+		"out *packet.DisConnect",
+	}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("unexpected packets, %v", seen)
+	}
+
+	if err := pw.Err(); err != nil {
+		t.Errorf("failed to write pcapng, %s", err)
+	}
+
+	// section header, interface description, and one enhanced packet block per packet
+	data := capture.Bytes()
+	blocks := 0
+	for len(data) >= 8 {
+		n := binary.LittleEndian.Uint32(data[4:])
+		data = data[n:]
+		blocks++
+	}
+	if blocks != 2+len(want) || len(data) != 0 {
+		t.Errorf("unexpected pcapng blocks, %d", blocks)
+	}
+}
+
+func TestStatsAndPing(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, nil)
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		rtt, err := c.Ping(ctx)
+		if err != nil {
+			t.Fatalf("failed to ping, %s", err)
+		}
+
+		if rtt <= 0 {
+			t.Errorf("invalid rtt, %s", rtt)
+		}
+	}
+
+	if err := c.Publish(ctx, "stats/test", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	stats := c.Stats()
+	if !stats.Connected || stats.Uptime <= 0 || stats.Server == nil {
+		t.Errorf("unexpected connection stats, %+v", stats)
+	}
+
+	// CONNECT, 3 PINGREQ, PUBLISH
+	if stats.PacketsSent != 5 || stats.PacketsReceived != 5 || stats.BytesSent == 0 || stats.BytesReceived == 0 {
+		t.Errorf("unexpected counters, %+v", stats)
+	}
+
+	if stats.Inflight != 0 || stats.LastPingRTT <= 0 {
+		t.Errorf("unexpected stats, %+v", stats)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{
+		RateLimit:       mqtt.RateLimit{MessagesPerSecond: 20, MessageBurst: 1, BytesPerSecond: 1000},
+		TopicRateLimits: map[string]mqtt.RateLimit{"alarm/": {}},
+	})
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := c.Publish(ctx, "telemetry/cpu", 0, false, []byte("1")); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("messages not limited, elapsed %s", elapsed)
+	}
+
+	start = time.Now()
+	for i := 0; i < 20; i++ {
+		if err := c.Publish(ctx, "alarm/fire", 1, false, []byte("1")); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("alarms should not be limited, elapsed %s", elapsed)
+	}
+
+	// the large message is allowed with a full bucket, the next one waits for the debt paid
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Publish(ctx, "telemetry/dump", 1, false, make([]byte, 3000)); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer shortCancel()
+	if err := c.Publish(shortCtx, "telemetry/dump", 1, false, make([]byte, 10)); !errors.Is(err, mqtt.ErrTimeout) {
+		t.Errorf("expect timeout, got %v", err)
+	}
+}
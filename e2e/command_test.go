@@ -2,6 +2,7 @@ package e2e_test
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/url"
 	"runtime"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	mqtt "github.com/openim/mqtt-client"
+	"github.com/openim/mqtt-client/topic"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -79,6 +81,22 @@ func (s *CommandTestSuite) TestPublishQos1() {
 	s.a.Nilf(err, "failed to publish, %s", err)
 }
 
+func (s *CommandTestSuite) TestPublishAsync() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tokens := make([]mqtt.Token, 0, 200)
+	for i := 0; i < cap(tokens); i++ {
+		tokens = append(tokens, s.c.PublishAsync(ctx, "test_topic", 1, false, []byte("hello")))
+	}
+
+	for _, tok := range tokens {
+		err := tok.Wait(ctx)
+		s.a.Nilf(err, "failed to publish, %s", err)
+		s.a.Nil(tok.Err())
+	}
+}
+
 func (s *CommandTestSuite) TestKeepalive() {
 	if testing.Short() {
 		return
@@ -94,6 +112,188 @@ func (s *CommandTestSuite) TestUnSubscribe() {
 	s.a.Nilf(err, "failed to unsubsribe, %s", err)
 }
 
+func (s *CommandTestSuite) TestMessages() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				s.c.Publish(ctx, "sensors/room1/temp", 1, false, []byte("21.5"))
+			}
+		}
+	}()
+
+	received := 0
+	for msg, err := range s.c.Messages(ctx, "sensors/#") {
+		if !s.a.Nilf(err, "failed to receive message, %s", err) {
+			break
+		}
+
+		s.a.Equal("sensors/room1/temp", msg.Topic())
+		s.a.Equal([]byte("21.5"), msg.Payload())
+		if received++; received == 2 {
+			break
+		}
+	}
+
+	s.a.Equal(2, received)
+}
+
+func (s *CommandTestSuite) TestInvalidTopic() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := s.c.Publish(ctx, "sensors/+/temp", 1, false, []byte("hello"))
+	s.a.True(errors.Is(err, topic.ErrWildcardInName), "unexpected error, %v", err)
+
+	err = s.c.Subscribe(ctx, "sensors/#/temp", 1, nil)
+	s.a.True(errors.Is(err, topic.ErrMultiLevelWildcard), "unexpected error, %v", err)
+
+	err = s.c.Subscribe(ctx, "sensors/room+", 1, nil)
+	var topicErr *topic.Error
+	s.a.True(errors.As(err, &topicErr), "unexpected error, %v", err)
+	s.a.Equal("sensors/room+", topicErr.Topic)
+
+	err = s.c.Unsubscribe(ctx, "")
+	s.a.True(errors.Is(err, topic.ErrEmpty), "unexpected error, %v", err)
+}
+
+func (s *CommandTestSuite) TestRetained() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	configs := map[string]string{
+		"config/device1/rate": "10",
+		"config/device2/rate": "20",
+	}
+	for topic, payload := range configs {
+		err := s.c.Publish(ctx, topic, 1, true, []byte(payload))
+		s.a.Nilf(err, "failed to publish, %s", err)
+	}
+
+	msgs, err := s.c.FetchRetained(ctx, "config/#", 200*time.Millisecond)
+	s.a.Nilf(err, "failed to fetch retained, %s", err)
+	s.a.Len(msgs, len(configs))
+	for _, msg := range msgs {
+		s.a.True(mqtt.IsRetained(msg))
+		s.a.Equal(configs[msg.Topic()], string(msg.Payload()))
+	}
+
+	err = s.c.ClearRetained(ctx, "config/device1/rate")
+	s.a.Nilf(err, "failed to clear retained, %s", err)
+
+	msgs, err = s.c.FetchRetained(ctx, "config/#", 200*time.Millisecond)
+	s.a.Nilf(err, "failed to fetch retained, %s", err)
+	if s.a.Len(msgs, 1) {
+		s.a.Equal("config/device2/rate", msgs[0].Topic())
+	}
+}
+
+func (s *CommandTestSuite) TestGetOnce() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := s.c.Publish(ctx, "state/device1", 1, true, []byte("online"))
+	s.a.Nilf(err, "failed to publish, %s", err)
+
+	msg, err := s.c.GetOnce(ctx, "state/+")
+	if s.a.Nilf(err, "failed to get message, %s", err) {
+		s.a.Equal("state/device1", msg.Topic())
+		s.a.Equal([]byte("online"), msg.Payload())
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer timeoutCancel()
+	_, err = s.c.GetOnce(timeoutCtx, "state/nothing")
+	s.a.True(errors.Is(err, mqtt.ErrTimeout), "unexpected error, %v", err)
+}
+
+func (s *CommandTestSuite) TestTemporarySubscriptionKeepsExisting() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan mqtt.Message, 10)
+	err := s.c.Subscribe(ctx, "owned/#", 1, func(msg mqtt.Message) {
+		received <- msg
+	})
+	s.a.Nilf(err, "failed to subscribe, %s", err)
+	expectReceived := func(name string) {
+		select {
+		case msg := <-received:
+			s.a.Equal(name, msg.Topic())
+		case <-ctx.Done():
+			s.a.Fail("message not received by the existing route")
+		}
+	}
+
+	err = s.c.Publish(ctx, "owned/state", 1, true, []byte("online"))
+	s.a.Nilf(err, "failed to publish, %s", err)
+	expectReceived("owned/state")
+
+	msg, err := s.c.GetOnce(ctx, "owned/#")
+	if s.a.Nilf(err, "failed to get message, %s", err) {
+		s.a.Equal([]byte("online"), msg.Payload())
+	}
+	expectReceived("owned/state") // the existing route is chained
+
+	msgs, err := s.c.FetchRetained(ctx, "owned/#", 200*time.Millisecond)
+	s.a.Nilf(err, "failed to fetch retained, %s", err)
+	s.a.Len(msgs, 1)
+	expectReceived("owned/state")
+
+	err = s.c.Publish(ctx, "owned/event", 1, false, []byte("still subscribed"))
+	s.a.Nilf(err, "failed to publish, %s", err)
+	expectReceived("owned/event")
+
+	err = s.c.ClearRetained(ctx, "owned/state")
+	s.a.Nilf(err, "failed to clear retained, %s", err)
+}
+
+func (s *CommandTestSuite) TestConcurrentGetOnce() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// a subscribes first and times out, its cleanup must not remove the subscription of b
+	errA := make(chan error, 1)
+	go func() {
+		ctxA, cancelA := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancelA()
+		_, err := s.c.GetOnce(ctxA, "shared/+")
+		errA <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	type result struct {
+		msg mqtt.Message
+		err error
+	}
+	resultB := make(chan result, 1)
+	go func() {
+		msg, err := s.c.GetOnce(ctx, "shared/+")
+		resultB <- result{msg, err}
+	}()
+
+	err := <-errA
+	s.a.True(errors.Is(err, mqtt.ErrTimeout), "unexpected error, %v", err)
+
+	err = s.c.Publish(ctx, "shared/event", 1, false, []byte("after a"))
+	s.a.Nilf(err, "failed to publish, %s", err)
+	select {
+	case r := <-resultB:
+		if s.a.Nilf(r.err, "failed to get message, %s", r.err) {
+			s.a.Equal("shared/event", r.msg.Topic())
+		}
+	case <-ctx.Done():
+		s.a.Fail("message not received after the other temporary subscriber left")
+	}
+}
+
 func TestCommandTestSuite(t *testing.T) {
 	suite.Run(t, new(CommandTestSuite))
 }
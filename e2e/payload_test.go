@@ -0,0 +1,538 @@
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/openim/mqtt-client"
+	"github.com/openim/mqtt-client/codec"
+)
+
+type sensorReading struct {
+	Sensor string            `msgpack:"sensor"`
+	Value  float64           `msgpack:"value"`
+	Tags   map[string]string `msgpack:"tags"`
+	Raw    []byte            `msgpack:"raw"`
+	Seq    int64             `msgpack:"seq"`
+	Skip   string            `msgpack:"-"`
+}
+
+func TestTypedPublishSubscribe(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, nil)
+	defer cleanFn()
+
+	codecs := map[string]codec.Codec{
+		"json":    codec.JSON,
+		"gob":     codec.Gob,
+		"msgpack": codec.MsgPack,
+	}
+
+	for name, cd := range codecs {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			received := make(chan sensorReading, 1)
+			decodeErrs := make(chan error, 1)
+			topic := "typed/" + name
+			err := mqtt.SubscribeTyped(ctx, c, cd, topic, 1, func(msg mqtt.Message, v sensorReading) {
+				received <- v
+			}, func(msg mqtt.Message, err error) {
+				decodeErrs <- err
+			})
+			if err != nil {
+				t.Fatalf("failed to subscribe, %s", err)
+			}
+
+			sent := sensorReading{
+				Sensor: "room1",
+				Value:  21.5,
+				Tags:   map[string]string{"floor": "1"},
+				Raw:    []byte{0, 1, 2},
+				Seq:    -1 << 40,
+				Skip:   "skipped",
+			}
+			if err := mqtt.PublishTyped(ctx, c, cd, topic, 1, false, sent); err != nil {
+				t.Fatalf("failed to publish, %s", err)
+			}
+
+			sent.Skip = ""
+			if name == "json" || name == "gob" {
+				sent.Skip = "skipped"
+			}
+
+			select {
+			case v := <-received:
+				if !reflect.DeepEqual(v, sent) {
+					t.Errorf("expect %+v, got %+v", sent, v)
+				}
+			case <-ctx.Done():
+				t.Fatalf("message not received")
+			}
+
+			if err := c.Publish(ctx, topic, 1, false, []byte{0xc1}); err != nil {
+				t.Fatalf("failed to publish, %s", err)
+			}
+
+			select {
+			case <-decodeErrs:
+			case <-ctx.Done():
+				t.Errorf("decode error not reported")
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	rawSizes := make(chan int, 3)
+	recordRaw := func(next mqtt.MessageHandler) mqtt.MessageHandler {
+		return func(msg mqtt.Message) {
+			rawSizes <- len(msg.Payload())
+			next(msg)
+		}
+	}
+
+	comp := &mqtt.Compression{Compressor: mqtt.Deflate, Threshold: 64}
+	opt := &mqtt.Options{}
+	mqtt.InstallPayloadCodecs(opt, comp)
+	opt.Middlewares = append([]mqtt.Middleware{recordRaw}, opt.Middlewares...)
+	c, cleanFn := MustConnectServer(t, opt)
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 3)
+	if err := c.Subscribe(ctx, "compression/#", 1, func(msg mqtt.Message) {
+		received <- msg.Payload()
+	}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	payloads := [][]byte{
+		[]byte(strings.Repeat("temperature=21.5;", 100)),
+		[]byte("small"),
+		[]byte("\x00Zlooks like compressed"),
+	}
+	for _, p := range payloads {
+		if err := c.Publish(ctx, "compression/data", 1, false, p); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+	}
+
+	for _, p := range payloads {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, p) {
+				t.Errorf("expect %q, got %q", p, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message not received")
+		}
+	}
+
+	if size := <-rawSizes; size >= len(payloads[0]) {
+		t.Errorf("payload not compressed, size=%d", size)
+	}
+}
+
+func TestCompressionLimit(t *testing.T) {
+	rejected := make(chan error, 1)
+	comp := &mqtt.Compression{MaxDecompressedSize: 1024, OnError: func(msg mqtt.Message, err error) {
+		rejected <- err
+	}}
+	opt := &mqtt.Options{}
+	mqtt.InstallPayloadCodecs(opt, comp)
+	c, cleanFn := MustConnectServer(t, opt)
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 2)
+	if err := c.Subscribe(ctx, "compression/#", 1, func(msg mqtt.Message) {
+		received <- msg.Payload()
+	}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	for _, size := range []int{1024, 1025} {
+		if err := c.Publish(ctx, "compression/data", 1, false, bytes.Repeat([]byte{'a'}, size)); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+	}
+
+	select {
+	case got := <-received:
+		if len(got) != 1024 {
+			t.Errorf("expect 1024 bytes, got %d", len(got))
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+
+	select {
+	case err := <-rejected:
+		if !errors.Is(err, mqtt.ErrDecompressedTooLarge) {
+			t.Errorf("expect ErrDecompressedTooLarge, got %v", err)
+		}
+	case got := <-received:
+		t.Errorf("oversized payload delivered, %d bytes", len(got))
+	case <-ctx.Done():
+		t.Fatalf("oversized payload not rejected")
+	}
+}
+
+func TestClearRetainedWithCodecs(t *testing.T) {
+	keyring := mqtt.NewKeyring()
+	if err := keyring.AddKey("tenant1/#", "k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("failed to add key, %s", err)
+	}
+
+	opt := &mqtt.Options{PublishInterceptors: []mqtt.PublishInterceptor{mqtt.TopicPrefix("tenant1/")}}
+	mqtt.InstallPayloadCodecs(opt, &mqtt.Compression{}, &mqtt.Encryption{Keyring: keyring})
+	c, cleanFn := MustConnectServer(t, opt)
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"config/a", "config/b"} {
+		if err := c.Publish(ctx, name, 1, true, []byte("on")); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+	}
+
+	if err := c.ClearRetained(ctx, "config/a"); err != nil {
+		t.Fatalf("failed to clear retained, %s", err)
+	}
+
+	msgs, err := c.FetchRetained(ctx, "tenant1/#", 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to fetch retained, %s", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].Topic() != "tenant1/config/b" || string(msgs[0].Payload()) != "on" {
+		t.Errorf("expect only tenant1/config/b retained, got %d messages", len(msgs))
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	servers, cleanServer := MustGetMqttServers(t)
+	defer cleanServer()
+
+	keyring := mqtt.NewKeyring()
+	if err := keyring.AddKey("secure/#", "k1", bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("failed to add key, %s", err)
+	}
+
+	rawPayloads := make(chan []byte, 10)
+	rejected := make(chan error, 10)
+	enc := &mqtt.Encryption{Keyring: keyring, OnError: func(msg mqtt.Message, err error) {
+		rejected <- err
+	}}
+	recordRaw := func(next mqtt.MessageHandler) mqtt.MessageHandler {
+		return func(msg mqtt.Message) {
+			rawPayloads <- msg.Payload()
+			next(msg)
+		}
+	}
+
+	opt := mqtt.Options{ClientID: "encrypted client"}
+	mqtt.InstallPayloadCodecs(&opt, enc)
+	opt.Middlewares = append([]mqtt.Middleware{recordRaw}, opt.Middlewares...)
+	c := mustConnect(t, servers, &opt)
+	defer c.Disconnect()
+	plain := mustConnect(t, servers, &mqtt.Options{ClientID: "plain client"})
+	defer plain.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 10)
+	if err := c.Subscribe(ctx, "secure/#", 1, func(msg mqtt.Message) {
+		received <- msg.Payload()
+	}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	expectReceived := func(expect []byte) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, expect) {
+				t.Errorf("expect %q, got %q", expect, got)
+			}
+		case err := <-rejected:
+			t.Errorf("message rejected, %s", err)
+		case <-ctx.Done():
+			t.Fatalf("message not received")
+		}
+	}
+
+	expectRejected := func() {
+		t.Helper()
+		select {
+		case got := <-received:
+			t.Errorf("message should be rejected, %q", got)
+		case <-rejected:
+		case <-ctx.Done():
+			t.Fatalf("message not received")
+		}
+	}
+
+	secret := []byte("open the valve")
+	if err := c.Publish(ctx, "secure/a", 1, false, secret); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	expectReceived(secret)
+	ciphertext := <-rawPayloads
+	if bytes.Contains(ciphertext, secret) {
+		t.Errorf("payload not encrypted")
+	}
+
+	// rotation, the old key still decrypts
+	if err := keyring.AddKey("secure/#", "k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatalf("failed to add key, %s", err)
+	}
+	if err := c.Publish(ctx, "secure/a", 1, false, secret); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	expectReceived(secret)
+	<-rawPayloads
+
+	if err := plain.Publish(ctx, "secure/a", 1, false, ciphertext); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	expectReceived(secret)
+	<-rawPayloads
+
+	// replay to another topic
+	if err := plain.Publish(ctx, "secure/b", 1, false, ciphertext); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	expectRejected()
+	<-rawPayloads
+
+	// plain message on encrypted topic
+	if err := plain.Publish(ctx, "secure/a", 1, false, secret); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	expectRejected()
+	<-rawPayloads
+
+	// retired key
+	keyring.RemoveKey("secure/#", "k1")
+	if err := plain.Publish(ctx, "secure/a", 1, false, ciphertext); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+	expectRejected()
+}
+
+func TestSigning(t *testing.T) {
+	servers, cleanServer := MustGetMqttServers(t)
+	defer cleanServer()
+
+	rawPayloads := make(chan []byte, 10)
+	rejected := make(chan error, 10)
+	signing := &mqtt.Signing{
+		KeyID:    "k1",
+		Keys:     map[string][]byte{"k1": []byte("actuator secret")},
+		Topics:   []string{"actuators/#"},
+		OnReject: func(msg mqtt.Message, err error) { rejected <- err },
+	}
+	recordRaw := func(next mqtt.MessageHandler) mqtt.MessageHandler {
+		return func(msg mqtt.Message) {
+			rawPayloads <- msg.Payload()
+			next(msg)
+		}
+	}
+
+	opt := mqtt.Options{ClientID: "signing client"}
+	mqtt.InstallPayloadCodecs(&opt, signing)
+	opt.Middlewares = append([]mqtt.Middleware{recordRaw}, opt.Middlewares...)
+	c := mustConnect(t, servers, &opt)
+	defer c.Disconnect()
+	plain := mustConnect(t, servers, &mqtt.Options{ClientID: "plain client"})
+	defer plain.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan []byte, 10)
+	if err := c.Subscribe(ctx, "actuators/#", 1, func(msg mqtt.Message) {
+		received <- msg.Payload()
+	}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	command := []byte("open")
+	if err := c.Publish(ctx, "actuators/valve", 1, false, command); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, command) {
+			t.Errorf("expect %q, got %q", command, got)
+		}
+	case err := <-rejected:
+		t.Fatalf("message rejected, %s", err)
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+	signed := <-rawPayloads
+
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-33] ^= 0xff
+	cases := []struct {
+		topic   string
+		payload []byte
+		err     error
+	}{
+		{"actuators/valve", signed, mqtt.ErrReplayed},
+		{"actuators/valve", tampered, mqtt.ErrInvalidSignature},
+		{"actuators/pump", signed, mqtt.ErrInvalidSignature},
+		{"actuators/valve", command, mqtt.ErrNotSigned},
+	}
+	for _, tc := range cases {
+		if err := plain.Publish(ctx, tc.topic, 1, false, tc.payload); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+
+		select {
+		case got := <-received:
+			t.Errorf("message should be rejected, %q", got)
+		case err := <-rejected:
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expect %v, got %v", tc.err, err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message not received")
+		}
+	}
+}
+
+type testSpan struct {
+	name   string
+	sc     mqtt.SpanContext
+	parent mqtt.SpanContext
+}
+
+func (s *testSpan) SpanContext() mqtt.SpanContext { return s.sc }
+
+func (s *testSpan) End(err error) {}
+
+type testTracer struct {
+	nextID atomic.Uint64
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string, kind mqtt.SpanKind, parent mqtt.SpanContext) mqtt.Span {
+	span := &testSpan{name: name, parent: parent, sc: mqtt.SpanContext{TraceID: parent.TraceID, Flags: 1}}
+	if !parent.IsValid() {
+		binary.BigEndian.PutUint64(span.sc.TraceID[8:], tr.nextID.Add(1))
+	}
+	binary.BigEndian.PutUint64(span.sc.SpanID[:], tr.nextID.Add(1))
+	return span
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &testTracer{}
+	tracing := &mqtt.Tracing{Tracer: tracer, Topics: []string{"tracing/#"}}
+	servers, cleanServer := MustGetMqttServers(t)
+	defer cleanServer()
+
+	opt := mqtt.Options{ClientID: "tracing client"}
+	mqtt.InstallPayloadCodecs(&opt, tracing)
+	c := mustConnect(t, servers, &opt)
+	defer c.Disconnect()
+	plain := mustConnect(t, servers, &mqtt.Options{ClientID: "plain client"})
+	defer plain.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	received := make(chan mqtt.Message, 1)
+	if err := c.Subscribe(ctx, "tracing/test", 1, func(msg mqtt.Message) {
+		received <- msg
+	}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	root := tracer.Start(ctx, "root", mqtt.SpanKindProducer, mqtt.SpanContext{})
+	if err := c.Publish(mqtt.ContextWithSpan(ctx, root), "tracing/test", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	var msg mqtt.Message
+	select {
+	case msg = <-received:
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+	if string(msg.Payload()) != "hello" {
+		t.Errorf("unexpected payload, %q", msg.Payload())
+	}
+
+	span, ok := mqtt.SpanFromContext(mqtt.MessageContext(msg))
+	if !ok {
+		t.Fatalf("span not found in message context")
+	}
+
+	consumer := span.(*testSpan)
+	if consumer.sc.TraceID != root.SpanContext().TraceID {
+		t.Errorf("trace not propagated, %s", consumer.sc.TraceParent())
+	}
+
+	if consumer.parent == root.SpanContext() || consumer.parent.TraceID != root.SpanContext().TraceID {
+		t.Errorf("consumer should be the child of producer span, parent=%s", consumer.parent.TraceParent())
+	}
+
+	parsed, err := mqtt.ParseTraceParent(consumer.sc.TraceParent())
+	if err != nil || parsed != consumer.sc {
+		t.Errorf("failed to parse traceparent, %v", err)
+	}
+
+	// not an envelope: a broken traceparent on traced topics, or any payload on the others
+	looksTraced := []byte("\x00T\x01\x03abc")
+	if err := c.Subscribe(ctx, "plain/test", 1, func(msg mqtt.Message) {
+		received <- msg
+	}); err != nil {
+		t.Fatalf("failed to subscribe, %s", err)
+	}
+
+	for _, name := range []string{"tracing/test", "plain/test"} {
+		if err := plain.Publish(ctx, name, 1, false, looksTraced); err != nil {
+			t.Fatalf("failed to publish, %s", err)
+		}
+
+		select {
+		case msg := <-received:
+			if !bytes.Equal(msg.Payload(), looksTraced) {
+				t.Errorf("payload of %s changed, %q", name, msg.Payload())
+			}
+		case <-ctx.Done():
+			t.Fatalf("message not received")
+		}
+	}
+
+	if err := c.Publish(ctx, "plain/test", 1, false, []byte("hello")); err != nil {
+		t.Fatalf("failed to publish, %s", err)
+	}
+
+	select {
+	case msg := <-received:
+		if string(msg.Payload()) != "hello" {
+			t.Errorf("trace context injected out of Topics, %q", msg.Payload())
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+}
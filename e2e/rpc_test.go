@@ -0,0 +1,68 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/openim/mqtt-client"
+	"github.com/openim/mqtt-client/codec"
+	"github.com/openim/mqtt-client/rpc"
+)
+
+type addArgs struct {
+	A, B int
+}
+
+func TestRPC(t *testing.T) {
+	c, cleanFn := MustConnectServer(t, &mqtt.Options{DispatchWorkers: 2})
+	defer cleanFn()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	server := rpc.NewServer(c, "rpc/calculator", codec.JSON)
+	rpc.Register(server, "add", func(ctx context.Context, args addArgs) (int, error) {
+		return args.A + args.B, nil
+	})
+	rpc.Register(server, "deadline", func(ctx context.Context, args struct{}) (bool, error) {
+		_, ok := ctx.Deadline()
+		return ok, nil
+	})
+	rpc.Register(server, "denied", func(ctx context.Context, args struct{}) (struct{}, error) {
+		return struct{}{}, &rpc.Error{Code: "permission_denied", Message: "not allowed"}
+	})
+	if err := server.Serve(ctx); err != nil {
+		t.Fatalf("failed to serve, %s", err)
+	}
+	defer server.Stop(ctx)
+
+	client := rpc.NewClient(c, "rpc/calculator", codec.JSON)
+	add := rpc.NewMethod[addArgs, int](client, "add")
+	sum, err := add.Call(ctx, addArgs{1, 2})
+	if err != nil || sum != 3 {
+		t.Errorf("unexpected result, %d, %v", sum, err)
+	}
+
+	hasDeadline, err := rpc.Call[struct{}, bool](ctx, client, "deadline", struct{}{})
+	if err != nil || !hasDeadline {
+		t.Errorf("deadline not propagated, %v", err)
+	}
+
+	var rpcErr *rpc.Error
+	_, err = rpc.Call[struct{}, struct{}](ctx, client, "denied", struct{}{})
+	if !errors.As(err, &rpcErr) || rpcErr.Code != "permission_denied" {
+		t.Errorf("unexpected error, %v", err)
+	}
+
+	_, err = rpc.Call[struct{}, struct{}](ctx, client, "missing", struct{}{})
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpc.CodeNotFound {
+		t.Errorf("unexpected error, %v", err)
+	}
+
+	_, err = rpc.Call[string, int](ctx, client, "add", "not a struct")
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpc.CodeInvalidArgument {
+		t.Errorf("unexpected error, %v", err)
+	}
+}
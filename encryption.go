@@ -0,0 +1,224 @@
+package mqtt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/openim/mqtt-client/topic"
+)
+
+// encryptionEnvelope marks the encrypted payloads, the field is the key ID and followed by:
+//
+//	nonce(12) | ciphertext
+//
+// The header and the topic are authenticated as associated data, so a message can not be replayed to other topics.
+var encryptionEnvelope = payloadEnvelope{"encryption", []byte{0x00, 'E'}, 1}
+
+var (
+	// ErrNoEncryptionKey returned when publishing to a topic whose keys are all removed.
+	ErrNoEncryptionKey = errors.New("no active encryption key")
+	// ErrNotEncrypted passed to Encryption.OnError when a plain message received on encrypted topics.
+	ErrNotEncrypted = errors.New("message not encrypted")
+)
+
+// Keyring keeps the AES keys by topic filter, a topic filter could have multiple keys for rotation,
+// the last added one is used for encryption and all of them are used for decryption.
+type Keyring struct {
+	sync.RWMutex
+	filters map[string]*filterKeys
+}
+
+type filterKeys struct {
+	active string // key ID used for encryption
+	keys   map[string]cipher.AEAD
+}
+
+// NewKeyring creates an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{filters: make(map[string]*filterKeys)}
+}
+
+// AddKey adds an AES-128, AES-192 or AES-256 key for topics matching filter, and makes it the active key.
+func (k *Keyring) AddKey(filter, keyID string, key []byte) error {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err
+	}
+
+	if len(keyID) == 0 || len(keyID) > 255 {
+		return fmt.Errorf("invalid key ID length %d", len(keyID))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	fk, ok := k.filters[filter]
+	if !ok {
+		fk = &filterKeys{keys: make(map[string]cipher.AEAD)}
+		k.filters[filter] = fk
+	}
+
+	fk.keys[keyID] = aead
+	fk.active = keyID
+	return nil
+}
+
+// RemoveKey removes a retired key, messages encrypted with it will be rejected.
+// Publishing fails with ErrNoEncryptionKey if the active key removed.
+func (k *Keyring) RemoveKey(filter, keyID string) {
+	k.Lock()
+	defer k.Unlock()
+	fk, ok := k.filters[filter]
+	if !ok {
+		return
+	}
+
+	delete(fk.keys, keyID)
+	if fk.active == keyID {
+		fk.active = ""
+	}
+}
+
+// lookup returns the keys of the most specific filter matching name, nil if name not encrypted.
+func (k *Keyring) lookup(name string) *filterKeys {
+	k.RLock()
+	defer k.RUnlock()
+	var matched []string
+	for f := range k.filters {
+		if topic.Match(f, name) {
+			matched = append(matched, f)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return filterSpecificity(matched[i]) > filterSpecificity(matched[j]) ||
+			(filterSpecificity(matched[i]) == filterSpecificity(matched[j]) && matched[i] < matched[j])
+	})
+	return k.filters[matched[0]]
+}
+
+// filterSpecificity prefers filters with more non-wildcard levels.
+func filterSpecificity(filter string) int {
+	n := 0
+	for _, level := range strings.Split(filter, "/") {
+		if level != "+" && level != "#" {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (k *Keyring) encrypt(name string, payload []byte) ([]byte, error) {
+	fk := k.lookup(name)
+	if fk == nil {
+		return payload, nil
+	}
+
+	k.RLock()
+	keyID := fk.active
+	aead := fk.keys[keyID]
+	k.RUnlock()
+	if aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := encryptionEnvelope.header(keyID, len(nonce)+len(payload)+aead.Overhead())
+	header := out[:len(out):len(out)]
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, payload, associatedData(header, name)), nil
+}
+
+// decrypt returns the plain payload, ok is false if name is not encrypted.
+func (k *Keyring) decrypt(name string, payload []byte) (plain []byte, ok bool, err error) {
+	fk := k.lookup(name)
+	if fk == nil {
+		return payload, false, nil
+	}
+
+	if !encryptionEnvelope.is(payload) {
+		return nil, true, ErrNotEncrypted
+	}
+
+	header, keyID, data, err := encryptionEnvelope.parse(payload)
+	if err != nil {
+		return nil, true, err
+	}
+
+	k.RLock()
+	aead := fk.keys[keyID]
+	k.RUnlock()
+	if aead == nil {
+		return nil, true, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, true, errors.New("invalid encryption nonce")
+	}
+
+	plain, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], associatedData(header, name))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to decrypt payload, %w", err)
+	}
+
+	return plain, true, nil
+}
+
+func associatedData(header []byte, name string) []byte {
+	ad := make([]byte, 0, len(header)+len(name))
+	ad = append(ad, header...)
+	return append(ad, name...)
+}
+
+// Encryption is a PayloadCodec encrypting payloads of topics with keys in Keyring by AES-GCM.
+//
+// It fails closed: messages received on encrypted topics which are plain, or failed to decrypt are dropped.
+// Install it after Compression, as encrypted payloads don't compress.
+type Encryption struct {
+	Keyring *Keyring
+	// OnError is called with the messages rejected. nil means logging.
+	OnError func(Message, error)
+}
+
+// Interceptor returns the PublishInterceptor encrypting payloads.
+func (e *Encryption) Interceptor() PublishInterceptor {
+	return payloadInterceptor(func(p *Publication) ([]byte, error) {
+		payload, err := e.Keyring.encrypt(p.Topic, p.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt payload, %w", err)
+		}
+
+		return payload, nil
+	})
+}
+
+// Middleware returns the Middleware decrypting payloads.
+func (e *Encryption) Middleware() Middleware {
+	return payloadMiddleware(func(msg Message) ([]byte, error) {
+		plain, _, err := e.Keyring.decrypt(msg.Topic(), msg.Payload())
+		return plain, err
+	}, e.OnError)
+}
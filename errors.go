@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+var (
+	// ErrNotConnected returned when calling API before Connect or after Disconnect.
+	ErrNotConnected = errors.New("not connected")
+
+	// ErrDisconnected returned when the connection is lost while waiting for response,
+	// the underlying network error is wrapped if any.
+	ErrDisconnected = errors.New("client disconnected")
+
+	// ErrTimeout returned when the deadline of context or network exceeded,
+	// context.DeadlineExceeded or the net.Error is wrapped.
+	ErrTimeout = errors.New("timeout")
+)
+
+// ConnackError returned when the server refused the connection.
+type ConnackError struct {
+	ReturnCode uint8
+}
+
+func (e *ConnackError) Error() string {
+	if msg, ok := packet.ConnackReturnCodes[e.ReturnCode]; ok {
+		return msg
+	}
+
+	return fmt.Sprintf("connack errcode=%d", e.ReturnCode)
+}
+
+// SubscribeError returned when the server refused the subscription of TopicFilter.
+type SubscribeError struct {
+	TopicFilter string
+	ReturnCode  byte
+}
+
+func (e *SubscribeError) Error() string {
+	return fmt.Sprintf("failed to subscribe %s, return code=0x%02x", e.TopicFilter, e.ReturnCode)
+}
+
+// ProtocolError returned when the server violates the MQTT protocol.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error, " + e.Reason
+}
+
+// timeoutError makes the error match ErrTimeout, and keeps the original error.
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s, %s", ErrTimeout, e.err)
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+// wrapTimeout wraps the deadline error of context or network with ErrTimeout.
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &timeoutError{err}
+	}
+
+	return err
+}
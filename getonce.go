@@ -0,0 +1,34 @@
+package mqtt
+
+import (
+	"context"
+)
+
+// GetOnce subscribes filter, returns the first message received and unsubscribes.
+// Its callback is removed when it returns, even if ctx is done. The subscription is kept as long as
+// filter is routed by Subscribe, SetRoute or other temporary subscribers, see subscribeTemporary.
+func (c *client) GetOnce(ctx context.Context, filter string) (Message, error) {
+	received := make(chan Message, 1)
+	exitChan, connExitChan := c.exitChans()
+	cleanup, err := c.subscribeTemporary(ctx, []string{filter}, func(msg Message) {
+		select {
+		case received <- msg:
+		default: // only the first one is needed
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	select {
+	case msg := <-received:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, wrapTimeout(ctx.Err())
+	case <-exitChan:
+		return nil, ErrDisconnected
+	case <-connExitChan:
+		return nil, ErrDisconnected
+	}
+}
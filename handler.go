@@ -1,10 +1,17 @@
 package mqtt
 
-import "log"
+import (
+	"slices"
+	"sync"
+
+	"github.com/openim/mqtt-client/packet"
+	"github.com/openim/mqtt-client/topic"
+)
 
 type messageHandlerInterface interface {
-	Register(topicFilters []string, qos []byte, callback MessageHandler)
-	Handle(message Message)
+	Register(topicFilter string, qos byte, callback MessageHandler)
+	Unregister(topicFilters ...string)
+	Handle(message Message) error
 }
 
 type filter struct {
@@ -13,14 +20,172 @@ type filter struct {
 }
 
 type messageHandler struct {
-	handlers map[filter]MessageHandler
+	sync.RWMutex
+	handlers map[string]route // key: topic filter
+	logger   Logger
+}
+
+type route struct {
+	filter
+	callback  MessageHandler
+	owned     bool              // set by Register, false if the route exists for the temporary subscribers only
+	temporary []*temporaryRoute // the callbacks of Messages, GetOnce and FetchRetained
+}
+
+// temporaryRoute is the callback of a temporary subscriber, its address identifies the subscriber.
+type temporaryRoute struct {
+	callback MessageHandler
+}
+
+func newMessageHandler(logger Logger) *messageHandler {
+	return &messageHandler{
+		handlers: make(map[string]route),
+		logger:   logger,
+	}
+}
+
+// Register set the callback of topicFilter, callback registered before will be replaced
+// unless the new one is nil. The temporary callbacks are kept.
+func (h *messageHandler) Register(topicFilter string, qos byte, callback MessageHandler) {
+	h.logger.Log(LogDebug, "register route", LogFieldTopic, topicFilter)
+	h.Lock()
+	r, ok := h.handlers[topicFilter]
+	if ok && callback == nil {
+		callback = r.callback // keep the route set by SetRoute
+	}
+	h.handlers[topicFilter] = route{filter{topicFilter, qos}, callback, true, r.temporary}
+	h.Unlock()
+}
+
+// Unregister removes the routes of topicFilters, the ones having temporary callbacks are kept for them.
+func (h *messageHandler) Unregister(topicFilters ...string) {
+	h.Lock()
+	for _, f := range topicFilters {
+		if r := h.handlers[f]; len(r.temporary) > 0 {
+			h.handlers[f] = route{filter: r.filter, temporary: r.temporary}
+		} else {
+			delete(h.handlers, f)
+		}
+	}
+	h.Unlock()
+}
+
+// Snapshot returns the routes of topicFilters, used to restore them if subscribing failed.
+func (h *messageHandler) Snapshot(topicFilters ...string) map[string]route {
+	h.RLock()
+	defer h.RUnlock()
+	snap := make(map[string]route)
+	for _, f := range topicFilters {
+		if r, ok := h.handlers[f]; ok && r.owned {
+			snap[f] = r
+		}
+	}
+
+	return snap
+}
+
+// Restore sets the routes of topicFilters back to the snapshot, the temporary callbacks are kept.
+// It returns the filters left without route.
+func (h *messageHandler) Restore(topicFilters []string, snap map[string]route) (removed []string) {
+	h.Lock()
+	defer h.Unlock()
+	for _, f := range topicFilters {
+		cur := h.handlers[f]
+		if r, ok := snap[f]; ok {
+			r.temporary = cur.temporary
+			h.handlers[f] = r
+		} else if len(cur.temporary) > 0 {
+			h.handlers[f] = route{filter: cur.filter, temporary: cur.temporary}
+		} else {
+			delete(h.handlers, f)
+			removed = append(removed, f)
+		}
+	}
+
+	return removed
+}
+
+// AddTemporary adds the temporary callback t to topicFilters, and returns the QoS to subscribe them with.
+func (h *messageHandler) AddTemporary(topicFilters []string, t *temporaryRoute) map[string]byte {
+	h.Lock()
+	defer h.Unlock()
+	subs := make(map[string]byte, len(topicFilters))
+	for _, f := range topicFilters {
+		r, ok := h.handlers[f]
+		if !ok {
+			r.filter = filter{f, packet.Qos1}
+		}
+
+		subs[f] = max(r.qos, packet.Qos1) // don't downgrade the subscription
+		r.temporary = append(r.temporary, t)
+		h.handlers[f] = r
+	}
+
+	return subs
 }
 
-func (h *messageHandler) Register(topicFilters string, qos byte, callback MessageHandler) {
-	log.Printf("register topicfilters=%s\n", topicFilters)
+// RemoveTemporary removes the temporary callback t from topicFilters, and returns the filters left without route.
+func (h *messageHandler) RemoveTemporary(topicFilters []string, t *temporaryRoute) (removed []string) {
+	h.Lock()
+	defer h.Unlock()
+	for _, f := range topicFilters {
+		r, ok := h.handlers[f]
+		if !ok {
+			continue
+		}
+
+		r.temporary = slices.DeleteFunc(r.temporary, func(x *temporaryRoute) bool { return x == t })
+		if len(r.temporary) == 0 && !r.owned {
+			delete(h.handlers, f)
+			removed = append(removed, f)
+		} else {
+			h.handlers[f] = r
+		}
+	}
+
+	return removed
 }
 
+// Unrouted returns the filters in topicFilters having no route.
+func (h *messageHandler) Unrouted(topicFilters []string) []string {
+	h.RLock()
+	defer h.RUnlock()
+	var unrouted []string
+	for _, f := range topicFilters {
+		if _, ok := h.handlers[f]; !ok {
+			unrouted = append(unrouted, f)
+		}
+	}
+
+	return unrouted
+}
+
+// Handle calls all the callbacks whose topic filter matches the message topic.
 func (h *messageHandler) Handle(message Message) error {
-	log.Printf("message processed [%s]:  %s\n", message.Topic(), message.Payload())
+	h.RLock()
+	var callbacks []MessageHandler
+	for f, r := range h.handlers {
+		if !topic.Match(f, message.Topic()) {
+			continue
+		}
+
+		if r.callback != nil {
+			callbacks = append(callbacks, r.callback)
+		}
+		for _, t := range r.temporary {
+			callbacks = append(callbacks, t.callback)
+		}
+	}
+	h.RUnlock()
+
+	if len(callbacks) == 0 {
+		h.logger.Log(LogDebug, "no route for message", LogFieldTopic, message.Topic())
+		return nil
+	}
+
+	for _, cb := range callbacks {
+		cb(message)
+	}
+
 	return nil
 }
@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTemporaryRoutes(t *testing.T) {
+	h := newMessageHandler(discardLogger)
+	a := &temporaryRoute{func(Message) {}}
+	b := &temporaryRoute{func(Message) {}}
+
+	h.AddTemporary([]string{"a/#", "b/#"}, a)
+	h.AddTemporary([]string{"a/#"}, b)
+	if removed := h.RemoveTemporary([]string{"a/#", "b/#"}, a); !slices.Equal(removed, []string{"b/#"}) {
+		t.Errorf("expect b/# removed, got %v", removed)
+	}
+	if r := h.handlers["a/#"]; len(r.temporary) != 1 || r.temporary[0] != b {
+		t.Errorf("expect the callback of b kept, got %+v", r)
+	}
+
+	// the route set meanwhile is kept after the last temporary subscriber leaves
+	h.Register("a/#", 0, func(Message) {})
+	if removed := h.RemoveTemporary([]string{"a/#"}, b); len(removed) != 0 {
+		t.Errorf("expect nothing removed, got %v", removed)
+	}
+	if r, ok := h.handlers["a/#"]; !ok || r.callback == nil || len(r.temporary) != 0 {
+		t.Errorf("expect the registered route only, got %+v", r)
+	}
+}
+
+func TestTemporaryQos(t *testing.T) {
+	h := newMessageHandler(discardLogger)
+	h.Register("qos0", 0, nil)
+	h.Register("qos2", 2, nil)
+	subs := h.AddTemporary([]string{"qos0", "qos2", "new"}, &temporaryRoute{func(Message) {}})
+	if subs["qos0"] != 1 || subs["qos2"] != 2 || subs["new"] != 1 {
+		t.Errorf("unexpected subscription qos, %v", subs)
+	}
+}
+
+func TestRestoreKeepsTemporary(t *testing.T) {
+	h := newMessageHandler(discardLogger)
+	tmp := &temporaryRoute{func(Message) {}}
+	snap := h.Snapshot("a", "b")
+	h.Register("a", 1, func(Message) {})
+	h.Register("b", 1, func(Message) {})
+	h.AddTemporary([]string{"a"}, tmp)
+
+	// subscribing a and b failed, a is still used by the temporary subscriber
+	if removed := h.Restore([]string{"a", "b"}, snap); !slices.Equal(removed, []string{"b"}) {
+		t.Errorf("expect b removed, got %v", removed)
+	}
+	if r := h.handlers["a"]; r.owned || r.callback != nil || len(r.temporary) != 1 {
+		t.Errorf("expect the temporary callback only, got %+v", r)
+	}
+}
@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxPacketID is the number of usable packet identifiers, 0 is not allowed.
+const maxPacketID = 65535
+
+type inflightEntry struct {
+	msgType byte // the expected response type, eg: packet.CtrlTypePUBACK
+	tok     *token
+}
+
+// inflightTable allocates packet identifiers, and keeps the requests waiting for response.
+//
+// SUBSCRIBE, UNSUBSCRIBE, and PUBLISH (in cases where QoS > 0) Control Packets MUST contain a non-zero 16-bit Packet Identifier [MQTT-2.3.1-1].
+// Each time a Client sends a new packet of one of these types it MUST assign it a currently unused Packet Identifier [MQTT-2.3.1-2].
+type inflightTable struct {
+	sync.Mutex
+	slots   chan struct{} // limits the number of in-flight requests
+	lastID  uint16
+	entries map[uint16]inflightEntry
+	err     error     // set when the connection is lost, new requests fail fast
+	gauge   func(int) // receives the number of entries when it changes
+}
+
+func newInflightTable(maxInflight int, gauge func(int)) *inflightTable {
+	if maxInflight <= 0 || maxInflight > maxPacketID {
+		maxInflight = maxPacketID
+	}
+
+	return &inflightTable{
+		slots:   make(chan struct{}, maxInflight),
+		entries: make(map[uint16]inflightEntry),
+		gauge:   gauge,
+	}
+}
+
+// acquire allocates an unused packet identifier for the request, and blocks when the window is full.
+func (t *inflightTable) acquire(ctx context.Context, msgType byte) (uint16, *token, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.err != nil {
+		<-t.slots
+		return 0, nil, t.err
+	}
+
+	id := t.lastID
+	for {
+		id++
+		if id == 0 {
+			continue
+		}
+
+		if _, busy := t.entries[id]; !busy {
+			break
+		}
+	}
+
+	tok := newToken()
+	tok.id = id
+	t.lastID = id
+	t.entries[id] = inflightEntry{msgType, tok}
+	t.gauge(len(t.entries))
+	return id, tok, nil
+}
+
+// sent records when the request of id is written to the connection.
+func (t *inflightTable) sent(msgType byte, id uint16, at time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if e, ok := t.entries[id]; ok && e.msgType == msgType {
+		e.tok.sentAt = at
+	}
+}
+
+// release removes the request of id and frees its slot, ok is false if msgType does not match.
+func (t *inflightTable) release(msgType byte, id uint16) (tok *token, ok bool) {
+	t.Lock()
+	e, ok := t.entries[id]
+	if ok && e.msgType == msgType {
+		delete(t.entries, id)
+		t.gauge(len(t.entries))
+	}
+	t.Unlock()
+
+	if !ok || e.msgType != msgType {
+		return nil, false
+	}
+
+	<-t.slots
+	return e.tok, true
+}
+
+// cancel removes the request of id if it's still waiting on tok, the response arrives later will be dropped.
+func (t *inflightTable) cancel(id uint16, tok *token) bool {
+	t.Lock()
+	e, ok := t.entries[id]
+	ok = ok && e.tok == tok
+	if ok {
+		delete(t.entries, id)
+		t.gauge(len(t.entries))
+	}
+	t.Unlock()
+
+	if ok {
+		<-t.slots
+	}
+	return ok
+}
+
+// failAll completes all the waiting requests with err, called when the connection is lost.
+func (t *inflightTable) failAll(err error) {
+	t.Lock()
+	entries := t.entries
+	t.entries = make(map[uint16]inflightEntry)
+	t.err = err
+	t.gauge(0)
+	t.Unlock()
+
+	for range entries {
+		<-t.slots
+	}
+
+	for _, e := range entries {
+		e.tok.complete(nil, err)
+	}
+}
+
+// len returns the number of requests waiting for response.
+func (t *inflightTable) len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.entries)
+}
+
+// open accepts new requests again after the connection established.
+func (t *inflightTable) open() {
+	t.Lock()
+	t.err = nil
+	t.Unlock()
+}
@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+func TestInflightWraparound(t *testing.T) {
+	table := newInflightTable(0, func(int) {})
+	table.lastID = maxPacketID - 1
+
+	for _, want := range []uint16{maxPacketID, 1, 2} {
+		id, _, err := table.acquire(context.Background(), packet.CtrlTypePUBACK)
+		if err != nil {
+			t.Fatalf("failed to acquire, %v", err)
+		}
+		if id != want {
+			t.Errorf("expect id %d, got %d", want, id)
+		}
+		table.release(packet.CtrlTypePUBACK, id)
+	}
+}
+
+func TestInflightNeverZero(t *testing.T) {
+	table := newInflightTable(0, func(int) {})
+	for i := 0; i < 2*maxPacketID; i++ {
+		id, _, err := table.acquire(context.Background(), packet.CtrlTypePUBACK)
+		if err != nil {
+			t.Fatalf("failed to acquire, %v", err)
+		}
+		if id == 0 {
+			t.Fatalf("packet id 0 is handed out after %d acquires", i)
+		}
+		table.release(packet.CtrlTypePUBACK, id)
+	}
+}
+
+func TestInflightSkipBusy(t *testing.T) {
+	table := newInflightTable(0, func(int) {})
+	busy := make(map[uint16]bool)
+	for i := 0; i < 3; i++ {
+		id, _, _ := table.acquire(context.Background(), packet.CtrlTypePUBACK)
+		busy[id] = true
+	}
+
+	// wrap around, the ids still waiting for response must be skipped
+	table.lastID = 0
+	id, _, err := table.acquire(context.Background(), packet.CtrlTypeSUBACK)
+	if err != nil {
+		t.Fatalf("failed to acquire, %v", err)
+	}
+	if busy[id] {
+		t.Errorf("busy id %d is handed out again", id)
+	}
+	if id != 4 {
+		t.Errorf("expect id 4, got %d", id)
+	}
+}
+
+func TestInflightWindowFull(t *testing.T) {
+	table := newInflightTable(2, func(int) {})
+	first, _, _ := table.acquire(context.Background(), packet.CtrlTypePUBACK)
+	table.acquire(context.Background(), packet.CtrlTypePUBACK)
+
+	acquired := make(chan uint16)
+	go func() {
+		id, _, err := table.acquire(context.Background(), packet.CtrlTypePUBACK)
+		if err != nil {
+			t.Errorf("failed to acquire, %v", err)
+		}
+		acquired <- id
+	}()
+
+	select {
+	case id := <-acquired:
+		t.Fatalf("expect acquire to block when the window is full, got id %d", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, ok := table.release(packet.CtrlTypePUBACK, first); !ok {
+		t.Fatalf("failed to release id %d", first)
+	}
+
+	select {
+	case id := <-acquired:
+		if id != 3 {
+			t.Errorf("expect id 3, got %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire is still blocked after release")
+	}
+}
+
+func TestInflightAcquireCancelled(t *testing.T) {
+	table := newInflightTable(1, func(int) {})
+	table.acquire(context.Background(), packet.CtrlTypePUBACK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := table.acquire(ctx, packet.CtrlTypePUBACK)
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expect context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire is not unblocked by ctx")
+	}
+
+	if n := table.len(); n != 1 {
+		t.Errorf("expect 1 entry, got %d", n)
+	}
+}
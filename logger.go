@@ -0,0 +1,160 @@
+package mqtt
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+// LogLevel is the severity of a log record.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Field names used by the client in keyvals.
+const (
+	LogFieldClientID   = "client_id"
+	LogFieldServer     = "server"
+	LogFieldPacketType = "packet_type"
+	LogFieldPacketID   = "packet_id"
+	LogFieldTopic      = "topic"
+	LogFieldError      = "error"
+)
+
+// Logger receives the logs of client, keyvals are alternating field names and values.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...any)
+}
+
+// LoggerFunc adapts a function to Logger.
+type LoggerFunc func(level LogLevel, msg string, keyvals ...any)
+
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...any) {
+	f(level, msg, keyvals...)
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to l, nil means slog.Default().
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+
+	return &slogLogger{l}
+}
+
+func (s *slogLogger) Log(level LogLevel, msg string, keyvals ...any) {
+	var sl slog.Level
+	switch level {
+	case LogDebug:
+		sl = slog.LevelDebug
+	case LogInfo:
+		sl = slog.LevelInfo
+	case LogWarn:
+		sl = slog.LevelWarn
+	default:
+		sl = slog.LevelError
+	}
+
+	s.l.Log(context.Background(), sl, msg, keyvals...)
+}
+
+type loggerKey struct{}
+
+// messageLogger returns the logger of the client receiving msg, logs are dropped if there is none.
+func messageLogger(msg Message) Logger {
+	if l, ok := MessageContext(msg).Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+
+	return LoggerFunc(func(LogLevel, string, ...any) {})
+}
+
+// log writes to Options.Logger with the client ID and server fields, it's silent if there is no logger.
+func (c *client) log(level LogLevel, msg string, keyvals ...any) {
+	if c.options.Logger == nil {
+		return
+	}
+
+	keyvals = append(keyvals, LogFieldClientID, c.options.ClientID)
+	if s := c.server.Load(); s != nil {
+		keyvals = append(keyvals, LogFieldServer, s.String())
+	}
+
+	c.options.Logger.Log(level, msg, keyvals...)
+}
+
+// packetType returns the name of control packet p, eg: "PUBLISH".
+func packetType(p any) string {
+	switch p.(type) {
+	case *packet.Connect:
+		return "CONNECT"
+	case *packet.ConnectAck:
+		return "CONNACK"
+	case *packet.Publish:
+		return "PUBLISH"
+	case *packet.PubAck:
+		return "PUBACK"
+	case *packet.Subscribe:
+		return "SUBSCRIBE"
+	case *packet.SubAck:
+		return "SUBACK"
+	case *packet.UnSubscribe:
+		return "UNSUBSCRIBE"
+	case *packet.UnSubAck:
+		return "UNSUBACK"
+	case *packet.PingReq:
+		return "PINGREQ"
+	case *packet.PingResp:
+		return "PINGRESP"
+	case *packet.DisConnect:
+		return "DISCONNECT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// packetFields returns the type and ID fields of packet p.
+func packetFields(p any) []any {
+	fields := []any{LogFieldPacketType, packetType(p)}
+	switch v := p.(type) {
+	case *packet.Publish:
+		return append(fields, LogFieldPacketID, v.ID, LogFieldTopic, v.Topic)
+	case *packet.PubAck:
+		return append(fields, LogFieldPacketID, v.ID)
+	case *packet.Subscribe:
+		return append(fields, LogFieldPacketID, v.ID)
+	case *packet.SubAck:
+		return append(fields, LogFieldPacketID, v.ID)
+	case *packet.UnSubscribe:
+		return append(fields, LogFieldPacketID, v.ID)
+	case *packet.UnSubAck:
+		return append(fields, LogFieldPacketID, v.ID)
+	default:
+		return fields
+	}
+}
@@ -1,8 +1,12 @@
 package mqtt
 
+import "context"
+
 type message struct {
-	topic   string
-	payload []byte
+	ctx      context.Context
+	topic    string
+	payload  []byte
+	retained bool
 }
 
 func (m *message) Topic() string {
@@ -12,3 +16,68 @@ func (m *message) Topic() string {
 func (m *message) Payload() []byte {
 	return m.payload
 }
+
+func (m *message) Retained() bool {
+	return m.retained
+}
+
+func (m *message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+
+	return m.ctx
+}
+
+// IsRetained reports whether the message is sent by server as a retained message,
+// messages wrapped by middlewares should implement Retained() or Unwrap() to keep it.
+func IsRetained(msg Message) bool {
+	for msg != nil {
+		switch m := msg.(type) {
+		case interface{ Retained() bool }:
+			return m.Retained()
+		case interface{ Unwrap() Message }:
+			msg = m.Unwrap()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// payloadMessage replaces the payload of a message, eg: decompressed or decrypted.
+type payloadMessage struct {
+	Message
+	payload []byte
+}
+
+func withPayload(msg Message, payload []byte) Message {
+	return &payloadMessage{msg, payload}
+}
+
+func (m *payloadMessage) Payload() []byte {
+	return m.payload
+}
+
+func (m *payloadMessage) Unwrap() Message {
+	return m.Message
+}
+
+// contextMessage replaces the context of a message, eg: with the span of tracing.
+type contextMessage struct {
+	Message
+	ctx context.Context
+}
+
+func withContext(msg Message, ctx context.Context) Message {
+	return &contextMessage{msg, ctx}
+}
+
+func (m *contextMessage) Context() context.Context {
+	return m.ctx
+}
+
+func (m *contextMessage) Unwrap() Message {
+	return m.Message
+}
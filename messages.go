@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/openim/mqtt-client/topic"
+)
+
+const (
+	messagesBufferSize = 16
+	cleanupTimeout     = 5 * time.Second // timeout of unsubscribing after the caller is gone
+)
+
+// Messages subscribes filters with QoS 1 and yields the messages received.
+//
+//	for msg, err := range client.Messages(ctx, "sensors/#") {
+//		if err != nil {
+//			break
+//		}
+//		...
+//	}
+//
+// The iterator yields a non-nil error and stops when ctx is done or the client disconnects.
+// The routes set by Subscribe or SetRoute are kept, see subscribeTemporary.
+func (c *client) Messages(ctx context.Context, filters ...string) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		exitChan, connExitChan := c.exitChans()
+		msgChan := make(chan Message, messagesBufferSize)
+		done := make(chan struct{})
+		callback := func(msg Message) {
+			select {
+			case msgChan <- msg:
+			case <-done:
+			}
+		}
+
+		cleanup, err := c.subscribeTemporary(ctx, filters, callback)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		defer func() {
+			close(done)
+			cleanup()
+		}()
+
+		for {
+			select {
+			case msg := <-msgChan:
+				if !yield(msg, nil) {
+					return
+				}
+			case <-ctx.Done():
+				yield(nil, wrapTimeout(ctx.Err()))
+				return
+			case <-exitChan:
+				yield(nil, ErrDisconnected)
+				return
+			case <-connExitChan:
+				yield(nil, ErrDisconnected)
+				return
+			}
+		}
+	}
+}
+
+// subscribeTemporary subscribes filters with QoS 1 for callback, the returned cleanup removes the subscription.
+// The temporary subscribers are counted per filter: callback is added next to the routes existing, and cleanup
+// removes it only. A filter is unsubscribed when its last temporary subscriber leaves, unless it's routed otherwise.
+func (c *client) subscribeTemporary(ctx context.Context, filters []string, callback MessageHandler) (cleanup func(), err error) {
+	for _, f := range filters {
+		if err := topic.ValidateFilter(f); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.IsConnected() {
+		return nil, ErrNotConnected
+	}
+
+	t := &temporaryRoute{callback}
+	err = c.subscribeRoutes(ctx, func() map[string]byte {
+		return c.handler.AddTemporary(filters, t)
+	}, func([]string) []string {
+		return c.handler.RemoveTemporary(filters, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		c.subsLock.Lock()
+		removed := c.handler.RemoveTemporary(filters, t)
+		c.subsLock.Unlock()
+		if !c.IsConnected() {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if err := c.unsubscribeUnrouted(ctx, removed); err != nil {
+			c.log(LogWarn, "failed to unsubscribe", LogFieldTopic, removed, LogFieldError, err)
+		}
+	}, nil
+}
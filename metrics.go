@@ -0,0 +1,44 @@
+package mqtt
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics receives the measurements of client, the methods are called in the hot path,
+// and must be fast and safe for concurrent use. See PrometheusMetrics.
+type Metrics interface {
+	// PacketSent is called for every packet written, packetType is the name such as "PUBLISH".
+	PacketSent(packetType string, bytes int)
+	// PacketReceived is called for every packet read.
+	PacketReceived(packetType string, bytes int)
+	// PublishAcked is called when the PUBACK arrives, latency is measured from writing the PUBLISH.
+	PublishAcked(latency time.Duration)
+	// Connected is called when the connection established, reconnect is false for the first time.
+	Connected(reconnect bool)
+	// Inflight is called when the number of requests waiting for response changes.
+	Inflight(n int)
+	// HandlerDone is called when an incoming message is handled, including the middlewares.
+	HandlerDone(topic string, d time.Duration)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) PacketSent(string, int)            {}
+func (nopMetrics) PacketReceived(string, int)        {}
+func (nopMetrics) PublishAcked(time.Duration)        {}
+func (nopMetrics) Connected(bool)                    {}
+func (nopMetrics) Inflight(int)                      {}
+func (nopMetrics) HandlerDone(string, time.Duration) {}
+
+// countingReader counts the bytes read, so the size of packet is known without encoding it again.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
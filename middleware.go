@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"context"
+	"strings"
+)
+
+// Middleware wraps the MessageHandler of incoming messages, eg: logging, recovery, metrics, decoding.
+type Middleware func(next MessageHandler) MessageHandler
+
+// Publication is an outgoing message passed through the PublishInterceptor chain,
+// interceptors could change the fields before passing it to next.
+type Publication struct {
+	Topic    string
+	Qos      byte
+	Retained bool
+	Payload  []byte
+}
+
+// PublishFunc sends a Publication.
+type PublishFunc func(ctx context.Context, p *Publication) error
+
+// PublishInterceptor wraps the sending of outgoing messages, returning an error without calling next rejects the publication.
+//
+// For Publish, next returns after the PUBACK received, for PublishAsync, next returns after the packet sent.
+type PublishInterceptor func(next PublishFunc) PublishFunc
+
+// Chain wraps h with middlewares, the first one is the outermost.
+func Chain(h MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+func chainPublishInterceptors(f PublishFunc, interceptors ...PublishInterceptor) PublishFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		f = interceptors[i](f)
+	}
+
+	return f
+}
+
+// Recover returns a Middleware recovering the panic of handlers, onPanic could be nil.
+func Recover(onPanic func(msg Message, v interface{})) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(msg Message) {
+			defer func() {
+				if v := recover(); v != nil {
+					messageLogger(msg).Log(LogError, "handler panic", LogFieldTopic, msg.Topic(), "panic", v)
+					if onPanic != nil {
+						onPanic(msg, v)
+					}
+				}
+			}()
+
+			next(msg)
+		}
+	}
+}
+
+// TopicPrefix returns a PublishInterceptor adding prefix to the topic of outgoing messages if missing, eg: tenant prefix.
+// The responses sent by Responder are not prefixed, they go to the reply topic chosen by the requester.
+func TopicPrefix(prefix string) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, p *Publication) error {
+			if !isReply(ctx) && !strings.HasPrefix(p.Topic, prefix) {
+				p.Topic = prefix + p.Topic
+			}
+
+			return next(ctx, p)
+		}
+	}
+}
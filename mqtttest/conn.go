@@ -1,8 +1,8 @@
 package mqtttest
 
 import (
+	"bufio"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -19,22 +19,27 @@ type protocol interface {
 
 type mqttConn struct {
 	net.Conn
+	reader   *bufio.Reader // packets are read byte by byte
 	connLock sync.Mutex
 
-	t            *testing.T
+	t            testing.TB
+	server       *testServer
 	disconnected int64
 	timeout      time.Duration // read timeout
+	nextPacketID uint32
 
 	serverExitCh chan struct{}
 	connExitCh   chan struct{}
 	wg           sync.WaitGroup
 }
 
-func newMQTTConn(t *testing.T, conn net.Conn, exitCh chan struct{}) protocol {
+func newMQTTConn(s *testServer, conn net.Conn) *mqttConn {
 	return &mqttConn{
 		Conn:         conn,
-		t:            t,
-		serverExitCh: exitCh,
+		reader:       bufio.NewReader(conn),
+		t:            s.t,
+		server:       s,
+		serverExitCh: s.exitCh,
 		connExitCh:   make(chan struct{}),
 	}
 }
@@ -63,7 +68,7 @@ func (c *mqttConn) incomingLoop() (err error) {
 	defer c.wg.Done()
 	for {
 		c.SetReadDeadline(time.Now().Add(c.timeout))
-		pkt, readErr := packet.ReadPacket(c)
+		pkt, readErr := packet.ReadPacket(c.reader)
 		if readErr != nil {
 			atomic.StoreInt64(&c.disconnected, 1)
 			err = readErr
@@ -72,32 +77,36 @@ func (c *mqttConn) incomingLoop() (err error) {
 
 		switch v := pkt.(type) {
 		case *packet.PingReq:
-			log.Printf("received ping req")
+			c.Logf("received ping req")
 			ack := &packet.PingResp{}
 			if sendErr := c.Send(ack); sendErr != nil {
 				err = sendErr
 				goto EXIT
 			}
 		case *packet.DisConnect:
-			log.Printf("received disconnected")
+			c.Logf("received disconnected")
 			goto EXIT
 		case *packet.Subscribe:
-			log.Printf("received subscribe")
+			c.Logf("received subscribe")
 			ack := &packet.SubAck{
 				ID:      v.ID,
 				RetCode: make([]byte, len(v.TopicFilter)), // TODO
 			}
 
 			for i, _ := range v.TopicFilter {
-				ack.RetCode[i] = 0
+				ack.RetCode[i] = v.QosLevel[i]
 			}
 
+			c.server.subscribe(c, v.TopicFilter, v.QosLevel)
 			if sendErr := c.Send(ack); sendErr != nil {
 				err = sendErr
 				goto EXIT
 			}
 
+			c.server.sendRetained(c, v.TopicFilter, v.QosLevel)
+
 		case *packet.Publish:
+			c.server.Publish(v.Topic, v.QosLevel, v.RetainFlag, v.Payload)
 			if v.QosLevel == 0 {
 				continue
 			}
@@ -110,7 +119,10 @@ func (c *mqttConn) incomingLoop() (err error) {
 				err = sendErr
 				goto EXIT
 			}
+		case *packet.PubAck:
+			// QoS 1 message delivered, nothing to do
 		case *packet.UnSubscribe:
+			c.server.unsubscribe(c, v.TopicFilter)
 			ack := &packet.UnSubAck{
 				ID: v.ID,
 			}
@@ -126,14 +138,36 @@ func (c *mqttConn) incomingLoop() (err error) {
 	}
 
 EXIT:
+	c.server.removeConn(c)
 	close(c.connExitCh)
 	return
 }
 
 func (c *mqttConn) outgoingLoop() error {
+	defer c.wg.Done()
 	return nil
 }
 
+// deliver sends a message to the client with the granted QoS.
+func (c *mqttConn) deliver(topic string, qos byte, retained bool, payload []byte) error {
+	msg := &packet.Publish{
+		Topic:      topic,
+		QosLevel:   qos,
+		RetainFlag: retained,
+		Payload:    payload,
+	}
+
+	if qos != packet.Qos0 {
+		id := uint16(atomic.AddUint32(&c.nextPacketID, 1))
+		if id == 0 {
+			id = uint16(atomic.AddUint32(&c.nextPacketID, 1))
+		}
+		msg.ID = id
+	}
+
+	return c.Send(msg)
+}
+
 type writepacket interface {
 	Write(io.Writer) error
 }
@@ -147,3 +181,7 @@ func (c *mqttConn) Send(p writepacket) error {
 func (c *mqttConn) Errorf(format string, args ...interface{}) {
 	c.t.Errorf(format, args...)
 }
+
+func (c *mqttConn) Logf(format string, args ...interface{}) {
+	c.t.Logf(format, args...)
+}
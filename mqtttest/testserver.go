@@ -2,7 +2,6 @@ package mqtttest
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"sync"
@@ -10,21 +9,35 @@ import (
 	"time"
 
 	"github.com/openim/mqtt-client/packet"
+	"github.com/openim/mqtt-client/topic"
 )
 
 // testServer is MQTT test broker
 type testServer struct {
-	t        *testing.T
+	t        testing.TB
 	listener net.Listener
 
 	exitCh chan struct{}
 	wg     sync.WaitGroup
+
+	subsLock      sync.Mutex
+	conns         map[*mqttConn]struct{}
+	subscriptions map[*mqttConn]map[string]byte // conn -> topic filter -> qos
+	retained      map[string]retainedMessage    // topic -> message
+}
+
+type retainedMessage struct {
+	qos     byte
+	payload []byte
 }
 
-func MustStartTestServer(t *testing.T) *testServer {
+func MustStartTestServer(t testing.TB) *testServer {
 	s := &testServer{
-		t:      t,
-		exitCh: make(chan struct{}),
+		t:             t,
+		exitCh:        make(chan struct{}),
+		conns:         make(map[*mqttConn]struct{}),
+		subscriptions: make(map[*mqttConn]map[string]byte),
+		retained:      make(map[string]retainedMessage),
 	}
 	s.Start()
 	return s
@@ -40,7 +53,7 @@ func (s *testServer) Start() error {
 	s.listener = listener
 	s.wg.Add(1)
 	go s.serve()
-	log.Printf("test server %s started. ", s.listener.Addr())
+	s.Logf("test server %s started. ", s.listener.Addr())
 	return nil
 }
 
@@ -56,20 +69,29 @@ func (s *testServer) Stop() {
 	}
 
 	s.listener.Close()
-	s.wg.Wait()
-	log.Printf("test server %s stopped. ", s.listener.Addr())
+	s.subsLock.Lock()
+	for c := range s.conns {
+		c.Conn.Close()
+	}
+	s.subsLock.Unlock()
+	s.wg.Wait() // no more logging after the test ends
+	s.Logf("test server %s stopped. ", s.listener.Addr())
 }
 
 func (s *testServer) Errorf(format string, args ...interface{}) {
 	s.t.Errorf(format, args...)
 }
 
+func (s *testServer) Logf(format string, args ...interface{}) {
+	s.t.Logf(format, args...)
+}
+
 func (s *testServer) serve() {
 	defer s.wg.Done()
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			log.Printf("testserver accept err, %s", err)
+			s.Logf("testserver accept err, %s", err)
 			return
 		}
 
@@ -93,18 +115,112 @@ func (s *testServer) handleConn(conn net.Conn) {
 		return
 	}
 
-	log.Printf("new mqtt connection, %s -> %s, %+v\n", conn.RemoteAddr(), conn.LocalAddr(), msg)
+	s.Logf("new mqtt connection, %s -> %s, %+v", conn.RemoteAddr(), conn.LocalAddr(), msg)
 
 	ack := &packet.ConnectAck{}
 	ack.Write(conn)
 
-	mconn := newMQTTConn(s.t, conn, s.exitCh)
+	mconn := newMQTTConn(s, conn)
 	mconn.SetTimeout(time.Second * time.Duration(msg.Keepalive) * 2)
+	s.subsLock.Lock()
+	s.conns[mconn] = struct{}{}
+	s.subsLock.Unlock()
 	mconn.Serve() // might be panic in side?
+	mconn.wg.Wait()
 
 	// session restore ????
 }
 
-// publish api from server
-func (s *testServer) Publish(topic string, qos byte, retained bool, payload []byte) {
+// Publish delivers message to all the subscribers
+func (s *testServer) Publish(name string, qos byte, retained bool, payload []byte) {
+	type delivery struct {
+		conn *mqttConn
+		qos  byte
+	}
+
+	var ds []delivery
+	s.subsLock.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(s.retained, name)
+		} else {
+			s.retained[name] = retainedMessage{qos, payload}
+		}
+	}
+
+	for conn, filters := range s.subscriptions {
+		for f, subQos := range filters {
+			if topic.Match(f, name) {
+				if subQos < qos {
+					ds = append(ds, delivery{conn, subQos})
+				} else {
+					ds = append(ds, delivery{conn, qos})
+				}
+				break
+			}
+		}
+	}
+	s.subsLock.Unlock()
+
+	for _, d := range ds {
+		if err := d.conn.deliver(name, d.qos, false, payload); err != nil {
+			s.Logf("failed to deliver message to %s, %s", d.conn.RemoteAddr(), err)
+		}
+	}
+}
+
+func (s *testServer) subscribe(c *mqttConn, filters []string, qos []byte) {
+	s.subsLock.Lock()
+	defer s.subsLock.Unlock()
+	subs, ok := s.subscriptions[c]
+	if !ok {
+		subs = make(map[string]byte)
+		s.subscriptions[c] = subs
+	}
+
+	for i, f := range filters {
+		subs[f] = qos[i]
+	}
+}
+
+// sendRetained sends the retained messages matching filters to the new subscriber.
+func (s *testServer) sendRetained(c *mqttConn, filters []string, qos []byte) {
+	type delivery struct {
+		topic string
+		qos   byte
+		msg   retainedMessage
+	}
+
+	var ds []delivery
+	s.subsLock.Lock()
+	for name, msg := range s.retained {
+		for i, f := range filters {
+			if topic.Match(f, name) {
+				ds = append(ds, delivery{name, min(qos[i], msg.qos), msg})
+				break
+			}
+		}
+	}
+	s.subsLock.Unlock()
+
+	for _, d := range ds {
+		if err := c.deliver(d.topic, d.qos, true, d.msg.payload); err != nil {
+			s.Logf("failed to deliver retained message to %s, %s", c.RemoteAddr(), err)
+		}
+	}
+}
+
+func (s *testServer) unsubscribe(c *mqttConn, filters []string) {
+	s.subsLock.Lock()
+	defer s.subsLock.Unlock()
+	for _, f := range filters {
+		delete(s.subscriptions[c], f)
+	}
+}
+
+func (s *testServer) removeConn(c *mqttConn) {
+	s.subsLock.Lock()
+	delete(s.conns, c)
+	delete(s.subscriptions, c)
+	s.subsLock.Unlock()
 }
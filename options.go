@@ -28,4 +28,49 @@ type Options struct {
 	MaxReconnectInterval time.Duration
 	WriteTimeout         time.Duration
 	AutoReconnect        bool
+
+	// MaxInflight limits the number of packets waiting for response(PUBACK, SUBACK, UNSUBACK),
+	// Publish, Subscribe and Unsubscribe block when the window is full. 0 means 65535.
+	MaxInflight int
+
+	// Middlewares wrap the handling of every incoming message, the first one is the outermost.
+	Middlewares []Middleware
+
+	// PublishInterceptors wrap every Publish and PublishAsync, the first one is the outermost.
+	PublishInterceptors []PublishInterceptor
+
+	// DispatchWorkers is the number of goroutines running message handlers,
+	// 0 means handlers run in the goroutine reading the connection.
+	DispatchWorkers int
+	// DispatchQueueSize is the queue size of each worker, 0 means 64.
+	DispatchQueueSize int
+	// DispatchOverflow decides what to do when the queue of worker is full.
+	DispatchOverflow OverflowPolicy
+	// DispatchKey returns the ordering key of message, messages with the same key are handled in order.
+	// nil means the topic of message.
+	DispatchKey func(Message) string
+
+	// ReplyTopicPrefix is the prefix of the reply topic used by Request, a random level is appended.
+	// Empty means "_reply".
+	ReplyTopicPrefix string
+
+	// Logger receives the logs of client, nil means silent. See NewSlogLogger.
+	Logger Logger
+
+	// Metrics receives the measurements of client, nil means disabled. See NewPrometheusMetrics.
+	Metrics Metrics
+
+	// PacketTap is called with every packet read and written, nil means disabled. See PcapngWriter.
+	PacketTap PacketTap
+
+	// RateLimit limits Publish and PublishAsync, they wait until allowed or ctx is done.
+	RateLimit RateLimit
+	// TopicRateLimits overrides RateLimit for the topics with the prefix, the longest prefix wins.
+	// eg: {"alarm/": {}} exempts alarms from the limit.
+	TopicRateLimits map[string]RateLimit
+
+	// WriteBufferSize is the size of the buffer coalescing outgoing packets, which is flushed when no more
+	// packets are queued or it's full. 0 means 4096, negative disables coalescing: every packet is written
+	// on its own.
+	WriteBufferSize int
 }
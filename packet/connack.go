@@ -22,6 +22,10 @@ var ConnackReturnCodes = map[uint8]string{
 
 func (msg *ConnectAck) Read(r io.Reader) error {
 	// TODO: move to ReadPacket, read full expect for Publish
+	if msg.RemainingLen != 2 {
+		return InvalidPacketLengthErr
+	}
+
 	buf := make([]byte, msg.RemainingLen)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
@@ -53,22 +53,27 @@ func (msg *Connect) Read(r io.Reader) error {
 	// Protocol Name, Protocol Level, Connect Flags, and Keep Alive
 
 	// Protocol Name
-	if binary.BigEndian.Uint16(buf[:2]) != 4 {
-		return errors.New("invalid protocol string len")
+	name, buf, err := decodeBytes(buf)
+	if err != nil {
+		return err
 	}
 
-	if string(buf[2:2+4]) != protocolName {
+	if string(name) != protocolName {
 		return errors.New("invalid protocol name")
 	}
 
+	if len(buf) < 4 {
+		return InvalidPacketLengthErr
+	}
+
 	// Protocol Level
-	v := uint8(buf[2+4])
+	v := uint8(buf[0])
 	if v != protocolLevel {
 		return errors.New("invalid protocol level")
 	}
 
 	// Connect Flags
-	connectFlags := buf[2+4+1]
+	connectFlags := buf[1]
 	msg.CleanSessionFlag = (connectFlags >> connectFlagOffsetCleanSession & 0x01) == 1
 	willFlag := (connectFlags >> connectFlagOffsetWillFlag & 0x01) == 1
 	msg.WillQoS = connectFlags >> connectFlagOffsetWillQos & 0x01
@@ -77,41 +82,50 @@ func (msg *Connect) Read(r io.Reader) error {
 	passwordFlag := (connectFlags >> connectFlagPasswordFlag & 0x01) == 1
 
 	// Keep Alive
-	buf = buf[2+4+1+1:]
-	msg.Keepalive = binary.BigEndian.Uint16(buf[:2])
+	msg.Keepalive = binary.BigEndian.Uint16(buf[2:4])
 
 	// =====Payload======
 	// These fields, if present, MUST appear in the order :
 	// Client Identifier, Will Topic, Will Message, User Name, Password [MQTT-3.1.3-1].
 
-	payload := buf[2:]
+	payload := buf[4:]
 	// Client Identifier
-	clientIDLen := binary.BigEndian.Uint16(payload[:2]) //TODO: zero-byte ClientId
-	msg.ClientID = string(payload[2 : 2+clientIDLen])
-	payload = payload[2+clientIDLen:]
+	clientID, payload, err := decodeBytes(payload) //TODO: zero-byte ClientId
+	if err != nil {
+		return err
+	}
+	msg.ClientID = string(clientID)
+
 	// Will Topic
 	// Will Message
 	if willFlag {
-		willTopicLen := binary.BigEndian.Uint16(payload[:2])
-		msg.WillTopic = string(payload[2 : 2+willTopicLen])
-		payload = payload[2+willTopicLen:]
+		var willTopic []byte
+		if willTopic, payload, err = decodeBytes(payload); err != nil {
+			return err
+		}
+		msg.WillTopic = string(willTopic)
 
-		willMessageLen := binary.BigEndian.Uint16(payload[:2])
-		msg.WillMessage = payload[2 : 2+willMessageLen]
-		payload = payload[2+willMessageLen:]
+		if msg.WillMessage, payload, err = decodeBytes(payload); err != nil {
+			return err
+		}
 	}
 
 	// User Name
 	if userNameFlag {
-		userNameLen := binary.BigEndian.Uint16(payload[:2])
-		msg.UserName = string(payload[2 : 2+userNameLen])
-		payload = payload[2+userNameLen:]
+		var userName []byte
+		if userName, payload, err = decodeBytes(payload); err != nil {
+			return err
+		}
+		msg.UserName = string(userName)
 	}
 
 	// Password
 	if passwordFlag {
-		passwordLen := binary.BigEndian.Uint16(payload[:2])
-		msg.Password = string(payload[2 : 2+passwordLen])
+		password, _, err := decodeBytes(payload)
+		if err != nil {
+			return err
+		}
+		msg.Password = string(password)
 	}
 	return nil
 }
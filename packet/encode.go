@@ -29,12 +29,14 @@ func encodeLength(length int) []byte {
 	return encLength
 }
 
-func decodeLength(r io.Reader) int {
+func decodeLength(r io.Reader) (int, error) {
 	var rLength uint32
 	var multiplier uint32
 	b := make([]byte, 1)
 	for multiplier < 27 { //fix: Infinite '(digit & 128) == 1' will cause the dead loop
-		io.ReadFull(r, b)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
 		digit := b[0]
 		rLength |= uint32(digit&127) << multiplier
 		if (digit & 128) == 0 {
@@ -42,5 +44,19 @@ func decodeLength(r io.Reader) int {
 		}
 		multiplier += 7
 	}
-	return int(rLength)
+	return int(rLength), nil
+}
+
+// decodeBytes reads a length prefixed field, and returns it with the rest of buf.
+func decodeBytes(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, InvalidPacketLengthErr
+	}
+
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if len(buf) < 2+n {
+		return nil, nil, InvalidPacketLengthErr
+	}
+
+	return buf[2 : 2+n], buf[2+n:], nil
 }
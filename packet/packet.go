@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 )
 
 var (
@@ -51,18 +50,21 @@ const (
 
 func ReadPacket(r io.Reader) (ControlPacket, error) {
 	first := make([]byte, 1)
-	if _, err := r.Read(first); err != nil {
+	if _, err := io.ReadFull(r, first); err != nil {
 		return nil, err
 	}
 
 	controlType := first[0] >> 4
 	fixFlags := first[0] & 0x0F
 	if controlType == CtrlTypeReserved1 || controlType == CtrlTypeReserved2 {
-		log.Printf("read invalid control type, %d", controlType)
 		return nil, errors.New("invalid control type")
 	}
 
-	remainingLen := decodeLength(r)
+	remainingLen, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+
 	if remainingLen > maxRemainingLen {
 		return nil, errors.New("remaining length error")
 	}
@@ -73,7 +75,11 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 		RemainingLen: uint32(remainingLen),
 	}
 
-	p := createPacket(h)
+	p, err := createPacket(h)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := p.Read(r); err != nil {
 		return nil, err
 	}
@@ -81,31 +87,31 @@ func ReadPacket(r io.Reader) (ControlPacket, error) {
 	return p, nil
 }
 
-func createPacket(h *FixedHeader) ControlPacket {
+func createPacket(h *FixedHeader) (ControlPacket, error) {
 	switch h.MsgType {
 	case CtrlTypeCONNECT:
-		return &Connect{FixedHeader: *h}
+		return &Connect{FixedHeader: *h}, nil
 	case CtrlTypeCONNECTACK:
-		return &ConnectAck{FixedHeader: *h}
+		return &ConnectAck{FixedHeader: *h}, nil
 	case CtrlTypePUBLISH:
-		return &Publish{FixedHeader: *h}
+		return &Publish{FixedHeader: *h}, nil
 	case CtrlTypePUBACK:
-		return &PubAck{FixedHeader: *h}
+		return &PubAck{FixedHeader: *h}, nil
 	case CtrlTypeSUBSCRIBE:
-		return &Subscribe{FixedHeader: *h}
+		return &Subscribe{FixedHeader: *h}, nil
 	case CtrlTypeSUBACK:
-		return &SubAck{FixedHeader: *h}
+		return &SubAck{FixedHeader: *h}, nil
 	case CtrlTypeUNSUBSCRIBE:
-		return &UnSubscribe{FixedHeader: *h}
+		return &UnSubscribe{FixedHeader: *h}, nil
 	case CtrlTypeUNSUBACK:
-		return &UnSubAck{FixedHeader: *h}
+		return &UnSubAck{FixedHeader: *h}, nil
 	case CtrlTypePINGREQ:
-		return &PingReq{FixedHeader: *h}
+		return &PingReq{FixedHeader: *h}, nil
 	case CtrlTypePINGRESP:
-		return &PingResp{FixedHeader: *h}
+		return &PingResp{FixedHeader: *h}, nil
 	case CtrlTypeDISCONNECT:
-		return &DisConnect{FixedHeader: *h}
+		return &DisConnect{FixedHeader: *h}, nil
 	default:
-		panic(fmt.Sprintf("invalid msg type, %d", h.MsgType))
+		return nil, fmt.Errorf("unsupported control type, %d", h.MsgType)
 	}
 }
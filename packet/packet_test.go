@@ -0,0 +1,140 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+var testPackets = map[string]ControlPacket{
+	"CONNECT": &Connect{
+		CleanSessionFlag: true,
+		Keepalive:        30,
+		ClientID:         "client",
+		WillTopic:        "will/topic",
+		WillMessage:      []byte("bye"),
+		UserName:         "user",
+		Password:         "password",
+	},
+	"CONNACK":     &ConnectAck{SessionPresent: true, ReturnCode: 0},
+	"PUBLISH":     &Publish{Topic: "a/b", QosLevel: Qos1, ID: 7, Payload: []byte("hello")},
+	"PUBLISH0":    &Publish{Topic: "a/b", Payload: []byte("hello")},
+	"PUBACK":      &PubAck{ID: 7},
+	"SUBSCRIBE":   &Subscribe{ID: 8, TopicFilter: []string{"a/+", "b/#"}, QosLevel: []byte{1, 0}},
+	"SUBACK":      &SubAck{ID: 8, RetCode: []byte{1, 0}},
+	"UNSUBSCRIBE": &UnSubscribe{ID: 9, TopicFilter: []string{"a/+", "b/#"}},
+	"UNSUBACK":    &UnSubAck{ID: 9},
+	"PINGREQ":     &PingReq{},
+	"PINGRESP":    &PingResp{},
+	"DISCONNECT":  &DisConnect{},
+}
+
+func encode(t *testing.T, p ControlPacket) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := p.Write(buf); err != nil {
+		t.Fatalf("failed to write, %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// splitPacket returns the first byte and the body after the remaining length.
+func splitPacket(t *testing.T, raw []byte) (byte, []byte) {
+	t.Helper()
+	r := bytes.NewReader(raw[1:])
+	if _, err := decodeLength(r); err != nil {
+		t.Fatalf("failed to decode length, %v", err)
+	}
+
+	return raw[0], raw[len(raw)-r.Len():]
+}
+
+func TestReadPacket(t *testing.T) {
+	for name, p := range testPackets {
+		t.Run(name, func(t *testing.T) {
+			raw := encode(t, p)
+			got, err := ReadPacket(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+
+			if again := encode(t, got); !bytes.Equal(raw, again) {
+				t.Errorf("packet changed after round trip, %x != %x", again, raw)
+			}
+		})
+	}
+}
+
+func TestReadTruncatedStream(t *testing.T) {
+	for name, p := range testPackets {
+		t.Run(name, func(t *testing.T) {
+			raw := encode(t, p)
+			for n := 0; n < len(raw); n++ {
+				if _, err := ReadPacket(bytes.NewReader(raw[:n])); err == nil {
+					t.Errorf("no error reading %d of %d bytes", n, len(raw))
+				}
+			}
+		})
+	}
+}
+
+// TestReadTruncatedBody reads the packets cut short with a matching remaining length,
+// they must fail or decode without panic.
+func TestReadTruncatedBody(t *testing.T) {
+	for name, p := range testPackets {
+		t.Run(name, func(t *testing.T) {
+			first, body := splitPacket(t, encode(t, p))
+			for n := 0; n < len(body); n++ {
+				raw := append([]byte{first}, encodeLength(n)...)
+				raw = append(raw, body[:n]...)
+				ReadPacket(bytes.NewReader(raw))
+			}
+		})
+	}
+}
+
+func TestReadInvalidPacket(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+	}{
+		{"CONNACK short", []byte{CtrlTypeCONNECTACK << 4, 1, 0}},
+		{"PUBLISH empty", []byte{CtrlTypePUBLISH << 4, 0}},
+		{"PUBLISH long topic", []byte{CtrlTypePUBLISH << 4, 3, 0, 5, 'a'}},
+		{"PUBLISH no packet id", []byte{CtrlTypePUBLISH<<4 | Qos1<<1, 3, 0, 1, 'a'}},
+		{"PUBACK short", []byte{CtrlTypePUBACK << 4, 1, 0}},
+		{"SUBACK no code", []byte{CtrlTypeSUBACK << 4, 2, 0, 1}},
+		{"SUBACK short", []byte{CtrlTypeSUBACK << 4, 1, 0}},
+		{"SUBSCRIBE no filter", []byte{CtrlTypeSUBSCRIBE<<4 | 2, 2, 0, 1}},
+		{"SUBSCRIBE no qos", []byte{CtrlTypeSUBSCRIBE<<4 | 2, 5, 0, 1, 0, 1, 'a'}},
+		{"UNSUBSCRIBE long filter", []byte{CtrlTypeUNSUBSCRIBE<<4 | 2, 5, 0, 1, 0, 9, 'a'}},
+		{"UNSUBACK short", []byte{CtrlTypeUNSUBACK << 4, 1, 0}},
+		{"CONNECT short", []byte{CtrlTypeCONNECT << 4, 3, 0, 4, 'M'}},
+		{"PINGRESP body", []byte{CtrlTypePINGRESP << 4, 1, 0}},
+		{"PUBREC unsupported", []byte{CtrlTypePUBREC << 4, 2, 0, 1}},
+		{"reserved type", []byte{CtrlTypeReserved2 << 4, 0}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ReadPacket(bytes.NewReader(c.raw)); err == nil {
+				t.Errorf("no error reading %x", c.raw)
+			}
+		})
+	}
+}
+
+func TestDecodeLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, maxRemainingLen} {
+		got, err := decodeLength(bytes.NewReader(encodeLength(n)))
+		if err != nil || got != n {
+			t.Errorf("decodeLength(%d) = %d, %v", n, got, err)
+		}
+	}
+
+	if _, err := decodeLength(bytes.NewReader([]byte{0x80, 0x80})); !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		t.Errorf("unexpected error of truncated length, %v", err)
+	}
+}
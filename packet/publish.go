@@ -29,23 +29,36 @@ const (
 )
 
 func (msg *Publish) Read(r io.Reader) error {
-	msg.RetainFlag = (msg.Flag | 1<<publishOffsetRetain) == 1
+	msg.RetainFlag = (msg.Flag>>publishOffsetRetain)&0x01 == 1
 	msg.QosLevel = (msg.Flag >> publishOffsetQos) & 0x03
-	msg.DupFlag = (msg.Flag | 1<<publishOffsetDup) == 1
+	msg.DupFlag = (msg.Flag>>publishOffsetDup)&0x01 == 1
 
 	buf := make([]byte, msg.RemainingLen)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 
-	topicLen := binary.BigEndian.Uint16(buf[:2])
+	if len(buf) < 2 {
+		return InvalidPacketLengthErr
+	}
+
+	topicLen := int(binary.BigEndian.Uint16(buf[:2]))
+	idLen := 0
+	if msg.QosLevel != Qos0 {
+		idLen = 2
+	}
+	if len(buf) < 2+topicLen+idLen {
+		return InvalidPacketLengthErr
+	}
+
 	msg.Topic = string(buf[2 : 2+topicLen])
 	buf = buf[2+topicLen:]
 	if msg.QosLevel != Qos0 {
 		msg.ID = binary.BigEndian.Uint16(buf[:2])
+		buf = buf[2:]
 	}
 
-	msg.Payload = buf[2:]
+	msg.Payload = buf
 	//log.Printf("received in pub %+v\n", msg)
 	return nil
 }
@@ -25,6 +25,10 @@ func (msg *SubAck) Read(r io.Reader) error {
 		return err
 	}
 
+	if len(buf) < 3 {
+		return InvalidPacketLengthErr
+	}
+
 	msg.ID = binary.BigEndian.Uint16(buf[:2])
 	msg.RetCode = buf[2:]
 	return nil
@@ -21,28 +21,31 @@ func (msg *Subscribe) Read(r io.Reader) error {
 		return err
 	}
 
-	msg.ID = binary.BigEndian.Uint16(buf[:2])
+	if len(buf) < 2 {
+		return InvalidPacketLengthErr
+	}
 
+	msg.ID = binary.BigEndian.Uint16(buf[:2])
 	buf = buf[2:]
-	for {
-		flen := binary.BigEndian.Uint16(buf[:2])
-		if int(2+flen+1) > len(buf) {
-			return errors.New("extra data in payload")
+	if len(buf) == 0 {
+		return errors.New("no topic filter in payload")
+	}
 
+	for len(buf) > 0 {
+		filter, rest, err := decodeBytes(buf)
+		if err != nil {
+			return err
 		}
-		topicFilter := string(buf[2 : 2+flen])
-		qos := buf[2+flen] & 0x03
-		msg.TopicFilter = append(msg.TopicFilter, topicFilter)
-		msg.QosLevel = append(msg.QosLevel, qos)
-		if 2+int(flen)+1 == int(msg.RemainingLen-2) {
-			break
+		if len(rest) == 0 {
+			return InvalidPacketLengthErr
 		}
 
-		buf = buf[2+flen+1:]
+		msg.TopicFilter = append(msg.TopicFilter, string(filter))
+		msg.QosLevel = append(msg.QosLevel, rest[0]&0x03)
+		buf = rest[1:]
 	}
 
 	return nil
-
 }
 
 func (msg *Subscribe) Write(w io.Writer) error {
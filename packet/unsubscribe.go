@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 )
 
 // TODO: subscribe multiple topics
@@ -21,23 +20,24 @@ func (msg *UnSubscribe) Read(r io.Reader) error {
 		return err
 	}
 
+	if len(buf) < 2 {
+		return InvalidPacketLengthErr
+	}
+
 	msg.ID = binary.BigEndian.Uint16(buf[:2])
 	buf = buf[2:]
-	for {
-		log.Printf("buf:%x, len=%d\n", buf, len(buf))
-		flen := binary.BigEndian.Uint16(buf[:2])
-		if int(2+flen) > len(buf) {
-			return errors.New("extra data in payload")
-
-		}
+	if len(buf) == 0 {
+		return errors.New("no topic filter in payload")
+	}
 
-		topicFilter := string(buf[2 : 2+flen])
-		msg.TopicFilter = append(msg.TopicFilter, topicFilter)
-		if len(buf)-int(2+flen) < 2 {
-			break
+	for len(buf) > 0 {
+		filter, rest, err := decodeBytes(buf)
+		if err != nil {
+			return err
 		}
 
-		buf = buf[2+flen:]
+		msg.TopicFilter = append(msg.TopicFilter, string(filter))
+		buf = rest
 	}
 
 	return nil
@@ -0,0 +1,143 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/openim/mqtt-client/topic"
+)
+
+// PayloadCodec transforms the payloads of outgoing messages and restores them on receive, eg: Compression,
+// Encryption, Signing and Tracing. The Interceptor and Middleware work in pairs, install them with InstallPayloadCodecs.
+type PayloadCodec interface {
+	Interceptor() PublishInterceptor
+	Middleware() Middleware
+}
+
+var (
+	_ PayloadCodec = (*Compression)(nil)
+	_ PayloadCodec = (*Encryption)(nil)
+	_ PayloadCodec = (*Signing)(nil)
+	_ PayloadCodec = (*Tracing)(nil)
+)
+
+// InstallPayloadCodecs appends the Interceptor of codecs to Options.PublishInterceptors, and puts their Middleware
+// before Options.Middlewares. Outgoing payloads are transformed in the order of codecs, and incoming payloads
+// are restored in the reverse order, eg: compressed then encrypted, decrypted then decompressed.
+//
+// Call it after adding the other interceptors, so all of them and the middlewares see the plain payloads.
+func InstallPayloadCodecs(options *Options, codecs ...PayloadCodec) {
+	middlewares := make([]Middleware, 0, len(codecs)+len(options.Middlewares))
+	for i := len(codecs) - 1; i >= 0; i-- {
+		middlewares = append(middlewares, codecs[i].Middleware())
+	}
+
+	for _, c := range codecs {
+		options.PublishInterceptors = append(options.PublishInterceptors, c.Interceptor())
+	}
+	options.Middlewares = append(middlewares, options.Middlewares...)
+}
+
+// payloadInterceptor returns the PublishInterceptor replacing the payload with the result of encode,
+// except for ClearRetained.
+func payloadInterceptor(encode func(p *Publication) ([]byte, error)) PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, p *Publication) error {
+			if isClearRetained(ctx) {
+				return next(ctx, p)
+			}
+
+			payload, err := encode(p)
+			if err != nil {
+				return err
+			}
+
+			p.Payload = payload
+			return next(ctx, p)
+		}
+	}
+}
+
+// payloadMiddleware returns the Middleware replacing the payload with the result of decode. The messages failed
+// to decode are dropped, and passed to onError, nil means logging.
+func payloadMiddleware(decode func(msg Message) ([]byte, error), onError func(Message, error)) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(msg Message) {
+			payload, err := decode(msg)
+			if err != nil {
+				dropMessage(msg, err, onError)
+				return
+			}
+
+			next(withPayload(msg, payload))
+		}
+	}
+}
+
+func dropMessage(msg Message, err error, onError func(Message, error)) {
+	if onError != nil {
+		onError(msg, err)
+		return
+	}
+
+	messageLogger(msg).Log(LogWarn, "drop message", LogFieldTopic, msg.Topic(), LogFieldError, err)
+}
+
+// payloadEnvelope is the header of the payloads transformed by a PayloadCodec:
+//
+//	magic(2) | version(1) | field length(1) | field
+//
+// The field is specific to the codec, eg: the key ID of Encryption.
+type payloadEnvelope struct {
+	name    string // used in errors, eg: "encryption"
+	magic   []byte
+	version byte
+}
+
+// header returns the header carrying field, with capacity for n more bytes.
+func (e payloadEnvelope) header(field string, n int) []byte {
+	buf := make([]byte, 0, len(e.magic)+2+len(field)+n)
+	buf = append(buf, e.magic...)
+	buf = append(buf, e.version, byte(len(field)))
+	return append(buf, field...)
+}
+
+// is reports whether payload starts with the magic of e.
+func (e payloadEnvelope) is(payload []byte) bool {
+	return bytes.HasPrefix(payload, e.magic)
+}
+
+// parse returns the header, the field in it, and the data after it.
+func (e payloadEnvelope) parse(payload []byte) (header []byte, field string, data []byte, err error) {
+	n := len(e.magic) + 2
+	if !e.is(payload) || len(payload) < n {
+		return nil, "", nil, fmt.Errorf("invalid %s header", e.name)
+	}
+
+	if v := payload[len(e.magic)]; v != e.version {
+		return nil, "", nil, fmt.Errorf("unsupported %s version %d", e.name, v)
+	}
+
+	n += int(payload[len(e.magic)+1])
+	if len(payload) < n {
+		return nil, "", nil, fmt.Errorf("invalid %s header", e.name)
+	}
+
+	return payload[:n], string(payload[len(e.magic)+2 : n]), payload[n:], nil
+}
+
+// matchTopics reports whether name matches any of filters, nil filters match all topics.
+func matchTopics(filters []string, name string) bool {
+	if filters == nil {
+		return true
+	}
+
+	for _, f := range filters {
+		if topic.Match(f, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,199 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// pcapng block types and the link type of raw IPv4 packets.
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngLinkTypeRaw     = 101
+	pcapngOptionEPBFlags  = 2
+	pcapngMaxSegment      = 65535 - 40 // IPv4 total length minus IPv4 and TCP headers
+	pcapngClientPort      = 49152
+	pcapngServerPort      = 1883
+	pcapngInitialSequence = 1
+)
+
+var (
+	pcapngClientIP = [4]byte{10, 0, 0, 1}
+	pcapngServerIP = [4]byte{10, 0, 0, 2}
+)
+
+// PcapngWriter writes the tapped packets in pcapng format, so they could be opened by Wireshark.
+// Packets are wrapped in synthetic IPv4/TCP headers between 10.0.0.1:49152 (client) and 10.0.0.2:1883 (server),
+// the port lets the MQTT dissector decode them. Use Tap as Options.PacketTap:
+//
+//	pw, _ := mqtt.NewPcapngWriter(file)
+//	client := mqtt.NewClient(mqtt.Options{PacketTap: pw.Tap, ...})
+type PcapngWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	seq [2]uint32 // next TCP sequence number of client and server
+	err error
+}
+
+// NewPcapngWriter writes the section header and interface description, and returns the writer.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	buf := &bytes.Buffer{}
+	le := binary.LittleEndian
+
+	// Section Header Block, without options
+	buf.Write(le.AppendUint32(nil, pcapngSectionHeader))
+	buf.Write(le.AppendUint32(nil, 28))
+	buf.Write(le.AppendUint32(nil, pcapngByteOrderMagic))
+	buf.Write(le.AppendUint16(nil, 1)) // major version
+	buf.Write(le.AppendUint16(nil, 0)) // minor version
+	buf.Write(le.AppendUint64(nil, 0xFFFFFFFFFFFFFFFF))
+	buf.Write(le.AppendUint32(nil, 28))
+
+	// Interface Description Block, microsecond timestamps by default
+	buf.Write(le.AppendUint32(nil, pcapngInterface))
+	buf.Write(le.AppendUint32(nil, 20))
+	buf.Write(le.AppendUint16(nil, pcapngLinkTypeRaw))
+	buf.Write(le.AppendUint16(nil, 0)) // reserved
+	buf.Write(le.AppendUint32(nil, 0)) // no snap length limit
+	buf.Write(le.AppendUint32(nil, 20))
+
+	if _, err := buf.WriteTo(w); err != nil {
+		return nil, err
+	}
+
+	return &PcapngWriter{
+		w:   w,
+		seq: [2]uint32{pcapngInitialSequence, pcapngInitialSequence},
+	}, nil
+}
+
+// Tap writes the packet, it's a PacketTap. The first error is kept and returned by Err.
+func (p *PcapngWriter) Tap(ev PacketEvent) {
+	p.WritePacket(ev)
+}
+
+// Err returns the first error of writing.
+func (p *PcapngWriter) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// WritePacket writes the raw bytes of the packet as TCP segments of the synthetic connection.
+func (p *PcapngWriter) WritePacket(ev PacketEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+
+	buf := &bytes.Buffer{}
+	for data := ev.Raw; len(data) > 0; {
+		n := min(len(data), pcapngMaxSegment)
+		p.writeBlock(buf, ev, p.segment(ev.Direction, data[:n]))
+		data = data[n:]
+	}
+
+	if _, err := buf.WriteTo(p.w); err != nil {
+		p.err = err
+	}
+	return p.err
+}
+
+// segment returns the IPv4 packet carrying data, and advances the sequence number.
+func (p *PcapngWriter) segment(dir Direction, data []byte) []byte {
+	src, dst := pcapngClientIP, pcapngServerIP
+	srcPort, dstPort := uint16(pcapngClientPort), uint16(pcapngServerPort)
+	seq, ack := &p.seq[0], p.seq[1]
+	if dir == DirectionIn {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &p.seq[1], p.seq[0]
+	}
+
+	be := binary.BigEndian
+	pkt := make([]byte, 40+len(data))
+	ip, tcp := pkt[:20], pkt[20:]
+
+	ip[0] = 0x45 // version 4, header length 20
+	be.PutUint16(ip[2:], uint16(len(pkt)))
+	be.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64                   // TTL
+	ip[9] = 6                    // TCP
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], dst[:])
+	be.PutUint16(ip[10:], ipChecksum(0, ip))
+
+	be.PutUint16(tcp[0:], srcPort)
+	be.PutUint16(tcp[2:], dstPort)
+	be.PutUint32(tcp[4:], *seq)
+	be.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // header length 20
+	tcp[13] = 0x18   // PSH, ACK
+	be.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], data)
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], src[:])
+	copy(pseudo[4:8], dst[:])
+	pseudo[9] = 6
+	be.PutUint16(pseudo[10:], uint16(len(tcp)))
+	be.PutUint16(tcp[16:], ipChecksum(onesSum(0, pseudo), tcp))
+
+	*seq += uint32(len(data))
+	return pkt
+}
+
+// writeBlock writes an Enhanced Packet Block with the direction in epb_flags.
+func (p *PcapngWriter) writeBlock(buf *bytes.Buffer, ev PacketEvent, data []byte) {
+	le := binary.LittleEndian
+	padded := (len(data) + 3) &^ 3
+	blockLen := uint32(28 + padded + 12 + 4)
+	ts := uint64(ev.Time.UnixMicro())
+
+	buf.Write(le.AppendUint32(nil, pcapngEnhancedPacket))
+	buf.Write(le.AppendUint32(nil, blockLen))
+	buf.Write(le.AppendUint32(nil, 0)) // interface ID
+	buf.Write(le.AppendUint32(nil, uint32(ts>>32)))
+	buf.Write(le.AppendUint32(nil, uint32(ts)))
+	buf.Write(le.AppendUint32(nil, uint32(len(data)))) // captured length
+	buf.Write(le.AppendUint32(nil, uint32(len(data)))) // original length
+	buf.Write(data)
+	buf.Write(make([]byte, padded-len(data)))
+
+	var flags uint32 = 1 // inbound
+	if ev.Direction == DirectionOut {
+		flags = 2
+	}
+	buf.Write(le.AppendUint16(nil, pcapngOptionEPBFlags))
+	buf.Write(le.AppendUint16(nil, 4))
+	buf.Write(le.AppendUint32(nil, flags))
+	buf.Write(le.AppendUint32(nil, 0)) // end of options
+	buf.Write(le.AppendUint32(nil, blockLen))
+}
+
+// onesSum adds data to the one's complement sum s.
+func onesSum(s uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+
+	return s
+}
+
+// ipChecksum returns the internet checksum of data, s is the sum of the pseudo header if any.
+func ipChecksum(s uint32, data []byte) uint16 {
+	s = onesSum(s, data)
+	for s>>16 != 0 {
+		s = s&0xFFFF + s>>16
+	}
+
+	return ^uint16(s)
+}
@@ -0,0 +1,169 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the histograms of PrometheusMetrics.
+var DefaultLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is a Metrics exposing the measurements in Prometheus text format, and is served as
+// an http.Handler. It must not be shared by clients, the inflight gauge is set by each of them:
+//
+//	metrics := mqtt.NewPrometheusMetrics()
+//	http.Handle("/metrics", metrics)
+//	client := mqtt.NewClient(mqtt.Options{Metrics: metrics, ...})
+type PrometheusMetrics struct {
+	mu              sync.Mutex
+	packetsSent     map[string]uint64 // key: packet type
+	packetsReceived map[string]uint64
+	bytesSent       map[string]uint64
+	bytesReceived   map[string]uint64
+	connects        uint64
+	reconnects      uint64
+	inflight        int
+	publishLatency  histogram
+	handlerDuration histogram
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // counts[i] is the number of observations in (buckets[i-1], buckets[i]]
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics with DefaultLatencyBuckets.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		packetsSent:     make(map[string]uint64),
+		packetsReceived: make(map[string]uint64),
+		bytesSent:       make(map[string]uint64),
+		bytesReceived:   make(map[string]uint64),
+		publishLatency:  newHistogram(DefaultLatencyBuckets),
+		handlerDuration: newHistogram(DefaultLatencyBuckets),
+	}
+}
+
+func (m *PrometheusMetrics) PacketSent(packetType string, bytes int) {
+	m.mu.Lock()
+	m.packetsSent[packetType]++
+	m.bytesSent[packetType] += uint64(bytes)
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) PacketReceived(packetType string, bytes int) {
+	m.mu.Lock()
+	m.packetsReceived[packetType]++
+	m.bytesReceived[packetType] += uint64(bytes)
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) PublishAcked(latency time.Duration) {
+	m.mu.Lock()
+	m.publishLatency.observe(latency.Seconds())
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) Connected(reconnect bool) {
+	m.mu.Lock()
+	m.connects++
+	if reconnect {
+		m.reconnects++
+	}
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) Inflight(n int) {
+	m.mu.Lock()
+	m.inflight = n
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) HandlerDone(topic string, d time.Duration) {
+	m.mu.Lock()
+	m.handlerDuration.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// WriteTo writes the metrics in Prometheus text format to w.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	m.mu.Lock()
+	writeCounterVec(buf, "mqtt_client_packets_sent_total", "Number of packets sent.", m.packetsSent)
+	writeCounterVec(buf, "mqtt_client_packets_received_total", "Number of packets received.", m.packetsReceived)
+	writeCounterVec(buf, "mqtt_client_bytes_sent_total", "Number of bytes sent.", m.bytesSent)
+	writeCounterVec(buf, "mqtt_client_bytes_received_total", "Number of bytes received.", m.bytesReceived)
+	writeMetric(buf, "mqtt_client_connects_total", "Number of connections established.", "counter", float64(m.connects))
+	writeMetric(buf, "mqtt_client_reconnects_total", "Number of connections established after the first one.", "counter", float64(m.reconnects))
+	writeMetric(buf, "mqtt_client_inflight", "Number of requests waiting for response.", "gauge", float64(m.inflight))
+	writeHistogram(buf, "mqtt_client_publish_latency_seconds", "Latency from writing PUBLISH to receiving PUBACK.", &m.publishLatency)
+	writeHistogram(buf, "mqtt_client_handler_duration_seconds", "Duration of handling incoming messages.", &m.handlerDuration)
+	m.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeMetric(w io.Writer, name, help, typ string, v float64) {
+	writeHeader(w, name, help, typ)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func writeCounterVec(w io.Writer, name, help string, values map[string]uint64) {
+	writeHeader(w, name, help, "counter")
+	types := make([]string, 0, len(values))
+	for t := range values {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+
+	for _, t := range types {
+		fmt.Fprintf(w, "%s{type=%q} %d\n", name, t, values[t])
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeHeader(w, name, help, "histogram")
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the rate of publishing with token buckets, zero rates mean unlimited.
+type RateLimit struct {
+	MessagesPerSecond float64
+	BytesPerSecond    float64 // counts the bytes of PUBLISH packets on the wire, including the headers and topic
+	// MessageBurst and ByteBurst are the bucket sizes, 0 means the rate of one second.
+	// A message larger than ByteBurst is allowed when the bucket is full, and the debt is paid later.
+	MessageBurst int
+	ByteBurst    int
+}
+
+// tokenBucket is filled at rate tokens per second up to burst, tokens could be negative
+// when the taken ones are reserved for the waiting callers.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = max(rate, 1)
+	}
+
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// reserve takes n tokens, and returns how long to wait before they are available.
+// n larger than burst only waits for a full bucket, the rest is paid by the later callers.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	var delay time.Duration
+	if need := min(n, b.burst); b.tokens < need {
+		delay = time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	}
+
+	b.tokens -= n
+	return delay
+}
+
+func (b *tokenBucket) refund(n float64) {
+	b.tokens = min(b.burst, b.tokens+n)
+}
+
+// limit is the buckets of a RateLimit, nil buckets are unlimited.
+type limit struct {
+	sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newLimit(r RateLimit) *limit {
+	l := &limit{}
+	if r.MessagesPerSecond > 0 {
+		l.messages = newTokenBucket(r.MessagesPerSecond, r.MessageBurst)
+	}
+	if r.BytesPerSecond > 0 {
+		l.bytes = newTokenBucket(r.BytesPerSecond, r.ByteBurst)
+	}
+
+	return l
+}
+
+// wait blocks until a message of size bytes is allowed, the tokens are given back if ctx is done first.
+func (l *limit) wait(ctx context.Context, size int) error {
+	if l.messages == nil && l.bytes == nil {
+		return nil
+	}
+
+	l.Lock()
+	now := time.Now()
+	var delay time.Duration
+	if l.messages != nil {
+		delay = l.messages.reserve(now, 1)
+	}
+	if l.bytes != nil {
+		delay = max(delay, l.bytes.reserve(now, float64(size)))
+	}
+	l.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		l.cancel(size)
+		return context.DeadlineExceeded
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(size)
+		return ctx.Err()
+	}
+}
+
+// cancel gives back the tokens reserved, the bucket might be refilled during waiting.
+func (l *limit) cancel(size int) {
+	l.Lock()
+	if l.messages != nil {
+		l.messages.refund(1)
+	}
+	if l.bytes != nil {
+		l.bytes.refund(float64(size))
+	}
+	l.Unlock()
+}
+
+type prefixLimit struct {
+	prefix string
+	limit  *limit
+}
+
+// rateLimiter applies the RateLimit of the longest matching topic prefix, or the default one.
+type rateLimiter struct {
+	defaultLimit *limit
+	prefixes     []prefixLimit // longest first
+}
+
+func newRateLimiter(options *Options) *rateLimiter {
+	l := &rateLimiter{defaultLimit: newLimit(options.RateLimit)}
+	for prefix, r := range options.TopicRateLimits {
+		l.prefixes = append(l.prefixes, prefixLimit{prefix, newLimit(r)})
+	}
+	sort.Slice(l.prefixes, func(i, j int) bool {
+		return len(l.prefixes[i].prefix) > len(l.prefixes[j].prefix)
+	})
+
+	return l
+}
+
+// publishSize returns the size of the PUBLISH packet on the wire.
+func publishSize(topic string, qos byte, payload []byte) int {
+	n := 2 + len(topic) + len(payload) // variable header and payload
+	if qos > 0 {
+		n += 2 // packet identifier
+	}
+
+	header := 2 // fixed header with one byte remaining length
+	for l := n; l >= 128; l /= 128 {
+		header++
+	}
+
+	return header + n
+}
+
+// wait blocks until publishing size bytes to topic is allowed or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, topic string, size int) error {
+	for _, p := range l.prefixes {
+		if strings.HasPrefix(topic, p.prefix) {
+			return p.limit.wait(ctx, size)
+		}
+	}
+
+	return l.defaultLimit.wait(ctx, size)
+}
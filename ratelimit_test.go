@@ -0,0 +1,37 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+func TestPublishSize(t *testing.T) {
+	for _, qos := range []byte{packet.Qos0, packet.Qos1} {
+		for _, n := range []int{0, 100, 123, 124, 125, 16000, 16383, 16384, 2097152} {
+			msg := &packet.Publish{Topic: "a/b", QosLevel: qos, Payload: []byte(strings.Repeat("x", n)), ID: 1}
+			raw, err := encodePacket(msg)
+			if err != nil {
+				t.Fatalf("failed to encode, %v", err)
+			}
+
+			if size := publishSize(msg.Topic, qos, msg.Payload); size != len(raw) {
+				t.Errorf("qos %d, payload %d: expect %d, got %d", qos, n, len(raw), size)
+			}
+		}
+	}
+}
+
+func TestRefundClampedToBurst(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 10)
+	b.last = now
+	b.reserve(now, 10)
+	b.reserve(now.Add(time.Second), 0) // refilled while the caller was waiting
+	b.refund(10)
+	if b.tokens != b.burst {
+		t.Errorf("expect %v tokens, got %v", b.burst, b.tokens)
+	}
+}
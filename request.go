@@ -0,0 +1,258 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+const (
+	defaultReplyTopicPrefix = "_reply"
+	replyTimeout            = 5 * time.Second // timeout of sending a response
+)
+
+// envelope wraps the payload of request and response, MQTT 3.1.1 has no response topic and correlation data.
+// It's encoded as the length of JSON header(2 bytes, big endian), the header, and the raw payload.
+type envelope struct {
+	ReplyTo       string `json:"reply_to,omitempty"`
+	CorrelationID string `json:"correlation_id"`
+	Payload       []byte `json:"-"` // not in the header, so it's not base64 encoded
+	Error         string `json:"error,omitempty"`
+	Deadline      int64  `json:"deadline,omitempty"` // unix nano, the deadline of request context
+}
+
+func (e *envelope) marshal() ([]byte, error) {
+	header, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(header) > math.MaxUint16 {
+		return nil, errors.New("envelope header too large")
+	}
+
+	data := make([]byte, 0, 2+len(header)+len(e.Payload))
+	data = binary.BigEndian.AppendUint16(data, uint16(len(header)))
+	data = append(data, header...)
+	return append(data, e.Payload...), nil
+}
+
+func (e *envelope) unmarshal(data []byte) error {
+	if len(data) < 2 {
+		return errors.New("truncated envelope")
+	}
+
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	if len(data) < n {
+		return errors.New("truncated envelope")
+	}
+
+	if err := json.Unmarshal(data[2:n], e); err != nil {
+		return err
+	}
+
+	if len(data) > n {
+		e.Payload = data[n:]
+	}
+	return nil
+}
+
+// ResponseError returned by Request when the responder returns an error.
+type ResponseError struct {
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return "response error, " + e.Message
+}
+
+// replies keeps the reply topic of the client and the requests waiting for response.
+type replies struct {
+	topic      string
+	subscribed bool // reset after connected, the subscription might be lost
+	pending    map[string]chan *envelope
+}
+
+func newReplies(prefix string) replies {
+	if prefix == "" {
+		prefix = defaultReplyTopicPrefix
+	}
+
+	return replies{
+		topic:   prefix + "/" + randomID(),
+		pending: make(map[string]chan *envelope),
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Request publishes payload to topic with QoS 1, and waits for the response sent by Responder.
+//
+// The client subscribes its reply topic at the first call. Don't call it in the MessageHandler
+// if handlers run inline(Options.DispatchWorkers is 0), the response can't be read.
+func (c *client) Request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	replyTopic, err := c.subscribeReplies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &envelope{
+		ReplyTo:       replyTopic,
+		CorrelationID: randomID(),
+		Payload:       payload,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Deadline = deadline.UnixNano()
+	}
+
+	data, err := req.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan *envelope, 1)
+	c.repliesLock.Lock()
+	c.replies.pending[req.CorrelationID] = respChan
+	c.repliesLock.Unlock()
+	defer func() {
+		c.repliesLock.Lock()
+		delete(c.replies.pending, req.CorrelationID)
+		c.repliesLock.Unlock()
+	}()
+
+	exitChan, connExitChan := c.exitChans()
+	if err := c.Publish(ctx, topic, packet.Qos1, false, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respChan:
+		if resp.Error != "" {
+			return nil, &ResponseError{resp.Error}
+		}
+
+		return resp.Payload, nil
+	case <-ctx.Done():
+		return nil, wrapTimeout(ctx.Err())
+	case <-exitChan:
+		return nil, ErrDisconnected
+	case <-connExitChan:
+		return nil, ErrDisconnected
+	}
+}
+
+// subscribeReplies subscribes the reply topic once, and returns it.
+func (c *client) subscribeReplies(ctx context.Context) (string, error) {
+	c.repliesLock.Lock()
+	if c.replies.subscribed {
+		c.repliesLock.Unlock()
+		return c.replies.topic, nil
+	}
+	replyTopic := c.replies.topic
+	c.repliesLock.Unlock()
+
+	// concurrent requests might subscribe more than once, which is harmless.
+	if err := c.Subscribe(ctx, replyTopic, packet.Qos1, c.handleReply); err != nil {
+		return "", err
+	}
+
+	c.repliesLock.Lock()
+	c.replies.subscribed = true
+	c.repliesLock.Unlock()
+	return replyTopic, nil
+}
+
+func (c *client) handleReply(msg Message) {
+	resp := &envelope{}
+	if err := resp.unmarshal(msg.Payload()); err != nil {
+		c.log(LogWarn, "invalid response", LogFieldTopic, msg.Topic(), LogFieldError, err)
+		return
+	}
+
+	c.repliesLock.Lock()
+	respChan, ok := c.replies.pending[resp.CorrelationID]
+	c.repliesLock.Unlock()
+	if !ok {
+		c.log(LogDebug, "drop response of unknown request", LogFieldTopic, msg.Topic(), "correlation_id", resp.CorrelationID)
+		return
+	}
+
+	select {
+	case respChan <- resp:
+	default: // duplicated response
+	}
+}
+
+// replyKey marks the responses published by Responder, whose topic is the exact ReplyTo of requester.
+type replyKey struct{}
+
+func isReply(ctx context.Context) bool {
+	_, ok := ctx.Value(replyKey{}).(bool)
+	return ok
+}
+
+// ResponderFunc handles the request, the returned payload or error is sent back to the requester.
+// ctx has the deadline of the requester's context if any.
+type ResponderFunc func(ctx context.Context, req Message) ([]byte, error)
+
+// Responder returns a MessageHandler serving the requests sent by Request, subscribe it to the request topic:
+//
+//	client.Subscribe(ctx, "svc/echo", 1, mqtt.Responder(client, fn))
+func Responder(c Client, fn ResponderFunc) MessageHandler {
+	return func(msg Message) {
+		req := &envelope{}
+		if err := req.unmarshal(msg.Payload()); err != nil || req.ReplyTo == "" {
+			messageLogger(msg).Log(LogWarn, "invalid request", LogFieldTopic, msg.Topic(), LogFieldError, err)
+			return
+		}
+
+		ctx := MessageContext(msg)
+		if req.Deadline != 0 {
+			deadline := time.Unix(0, req.Deadline)
+			if time.Now().After(deadline) {
+				messageLogger(msg).Log(LogWarn, "drop expired request", LogFieldTopic, msg.Topic(), "correlation_id", req.CorrelationID)
+				return
+			}
+
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+
+		resp := &envelope{CorrelationID: req.CorrelationID}
+		payload, err := fn(ctx, withPayload(msg, req.Payload))
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Payload = payload
+		}
+
+		data, err := resp.marshal()
+		if err != nil {
+			messageLogger(msg).Log(LogError, "failed to encode response", LogFieldTopic, msg.Topic(), LogFieldError, err)
+			return
+		}
+
+		// the response is sent even if the deadline of request passed while handling, the requester decides.
+		// It's published in background, the rate limit and the MaxInflight window might block the handler,
+		// which is reading the connection if handlers run inline.
+		replyCtx, cancel := context.WithTimeout(context.WithValue(context.WithoutCancel(ctx), replyKey{}, true), replyTimeout)
+		go func() {
+			defer cancel()
+			if err := c.Publish(replyCtx, req.ReplyTo, packet.Qos1, false, data); err != nil {
+				messageLogger(msg).Log(LogWarn, "failed to send response", LogFieldTopic, req.ReplyTo, LogFieldError, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+// ClearRetained publishes a zero-length retained message to the topic name, so the server removes the retained message.
+// It goes through the PublishInterceptors, but the PayloadCodecs leave the payload empty, or it's not removed.
+func (c *client) ClearRetained(ctx context.Context, name string) error {
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	return c.publish(context.WithValue(ctx, clearRetainedKey{}, true), &Publication{name, packet.Qos1, true, nil})
+}
+
+// clearRetainedKey marks the publication of ClearRetained, whose payload must not be transformed.
+type clearRetainedKey struct{}
+
+func isClearRetained(ctx context.Context) bool {
+	_, ok := ctx.Value(clearRetainedKey{}).(bool)
+	return ok
+}
+
+// FetchRetained subscribes filter, collects the retained messages until no new one arrives in settle time,
+// and unsubscribes unless filter has been subscribed before. The messages collected are returned with the error if ctx done or disconnected.
+func (c *client) FetchRetained(ctx context.Context, filter string, settle time.Duration) ([]Message, error) {
+	var (
+		lock     sync.Mutex
+		messages []Message
+		arrived  = make(chan struct{}, 1)
+	)
+
+	exitChan, connExitChan := c.exitChans()
+	cleanup, err := c.subscribeTemporary(ctx, []string{filter}, func(msg Message) {
+		if !IsRetained(msg) {
+			return
+		}
+
+		lock.Lock()
+		messages = append(messages, msg)
+		lock.Unlock()
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	collected := func() []Message {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]Message(nil), messages...)
+	}
+
+	timer := time.NewTimer(settle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-arrived:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(settle)
+		case <-timer.C:
+			return collected(), nil
+		case <-ctx.Done():
+			return collected(), wrapTimeout(ctx.Err())
+		case <-exitChan:
+			return collected(), ErrDisconnected
+		case <-connExitChan:
+			return collected(), ErrDisconnected
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package rpc implements RPC over MQTT on top of mqtt.Request and mqtt.Responder.
+//
+// Methods are served under a topic prefix, eg: rpc/{service}/{method}, arguments and results are encoded
+// with a codec.Codec, and the deadline of the caller's context is propagated to the server.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqtt "github.com/openim/mqtt-client"
+	"github.com/openim/mqtt-client/codec"
+)
+
+// Error codes of Error.
+const (
+	CodeNotFound         = "not_found"
+	CodeInvalidArgument  = "invalid_argument"
+	CodeDeadlineExceeded = "deadline_exceeded"
+	CodeInternal         = "internal"
+)
+
+// Error is the structured error returned to callers, methods could return it with their own codes.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error, code=%s, %s", e.Code, e.Message)
+}
+
+// The payload of mqtt response starts with a status byte, followed by the raw result encoded by codec,
+// or the JSON of Error.
+const (
+	statusOK    byte = 0
+	statusError byte = 1
+)
+
+type handler func(ctx context.Context, args []byte) ([]byte, error)
+
+// Server serves the registered methods at {prefix}/{method}.
+type Server struct {
+	c      mqtt.Client
+	prefix string
+	codec  codec.Codec
+
+	lock    sync.RWMutex
+	methods map[string]handler
+}
+
+// NewServer creates a Server, prefix is the topic prefix of methods, eg: rpc/devices.
+func NewServer(c mqtt.Client, prefix string, cd codec.Codec) *Server {
+	return &Server{
+		c:       c,
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		codec:   cd,
+		methods: make(map[string]handler),
+	}
+}
+
+// Register registers fn as method of s, the method registered before is replaced.
+func Register[A, R any](s *Server, method string, fn func(ctx context.Context, args A) (R, error)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.methods[method] = func(ctx context.Context, data []byte) ([]byte, error) {
+		var args A
+		if err := s.codec.Unmarshal(data, &args); err != nil {
+			return nil, &Error{CodeInvalidArgument, err.Error()}
+		}
+
+		result, err := fn(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.codec.Marshal(result)
+	}
+}
+
+// Serve subscribes the topics of methods, the methods registered later are also served.
+// Methods run in the MessageHandler, set Options.DispatchWorkers so slow methods don't block the client.
+func (s *Server) Serve(ctx context.Context) error {
+	return s.c.Subscribe(ctx, s.prefix+"/+", 1, mqtt.Responder(s.c, s.handle))
+}
+
+// Stop unsubscribes the topics of methods.
+func (s *Server) Stop(ctx context.Context) error {
+	return s.c.Unsubscribe(ctx, s.prefix+"/+")
+}
+
+func (s *Server) handle(ctx context.Context, req mqtt.Message) ([]byte, error) {
+	method := req.Topic()[strings.LastIndex(req.Topic(), "/")+1:]
+	s.lock.RLock()
+	h, ok := s.methods[method]
+	s.lock.RUnlock()
+
+	var rpcErr *Error
+	if !ok {
+		rpcErr = &Error{CodeNotFound, "method not found: " + method}
+	} else if result, err := h(ctx, req.Payload()); err != nil {
+		rpcErr = toError(ctx, err)
+	} else if ctx.Err() == context.DeadlineExceeded { // the result is useless to caller
+		rpcErr = &Error{CodeDeadlineExceeded, ctx.Err().Error()}
+	} else {
+		return append([]byte{statusOK}, result...), nil
+	}
+
+	data, err := json.Marshal(rpcErr)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{statusError}, data...), nil
+}
+
+func toError(ctx context.Context, err error) *Error {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &Error{CodeDeadlineExceeded, err.Error()}
+	}
+
+	return &Error{CodeInternal, err.Error()}
+}
+
+// Client calls the methods served at {prefix}/{method}.
+type Client struct {
+	c      mqtt.Client
+	prefix string
+	codec  codec.Codec
+}
+
+// NewClient creates a Client, prefix and cd must be the same as the Server.
+func NewClient(c mqtt.Client, prefix string, cd codec.Codec) *Client {
+	return &Client{
+		c:      c,
+		prefix: strings.TrimSuffix(prefix, "/"),
+		codec:  cd,
+	}
+}
+
+// Call calls method with args, the deadline of ctx is enforced by the server too.
+// A *Error is returned if the method failed.
+func Call[A, R any](ctx context.Context, cl *Client, method string, args A) (R, error) {
+	var result R
+	data, err := cl.codec.Marshal(args)
+	if err != nil {
+		return result, err
+	}
+
+	payload, err := cl.c.Request(ctx, cl.prefix+"/"+method, data)
+	if err != nil {
+		return result, err
+	}
+
+	if len(payload) == 0 {
+		return result, errors.New("invalid rpc response, empty payload")
+	}
+
+	switch payload[0] {
+	case statusOK:
+	case statusError:
+		rpcErr := &Error{}
+		if err := json.Unmarshal(payload[1:], rpcErr); err != nil {
+			return result, fmt.Errorf("invalid rpc response, %w", err)
+		}
+		return result, rpcErr
+	default:
+		return result, fmt.Errorf("invalid rpc response, status %d", payload[0])
+	}
+
+	if err := cl.codec.Unmarshal(payload[1:], &result); err != nil {
+		return result, fmt.Errorf("failed to decode rpc result, %w", err)
+	}
+
+	return result, nil
+}
+
+// Method is a typed stub of a remote method.
+type Method[A, R any] struct {
+	client *Client
+	name   string
+}
+
+// NewMethod creates the stub of method.
+func NewMethod[A, R any](cl *Client, name string) Method[A, R] {
+	return Method[A, R]{cl, name}
+}
+
+// Call calls the remote method.
+func (m Method[A, R]) Call(ctx context.Context, args A) (R, error) {
+	return Call[A, R](ctx, m.client, m.name, args)
+}
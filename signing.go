@@ -0,0 +1,185 @@
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// signingEnvelope marks the signed payloads, the field is the key ID and followed by:
+//
+//	timestamp(8, unix nano) | nonce(16) | payload | HMAC-SHA256(32)
+//
+// The HMAC covers the header, the data before it, the topic length(2) and the topic.
+var signingEnvelope = payloadEnvelope{"signing", []byte{0x00, 'S'}, 1}
+
+const (
+	signingNonceSize    = 16
+	defaultReplayWindow = 5 * time.Minute
+)
+
+var (
+	// ErrNotSigned passed to Signing.OnReject when an unsigned message received.
+	ErrNotSigned = errors.New("message not signed")
+	// ErrInvalidSignature passed to Signing.OnReject when the HMAC does not match.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrSignatureExpired passed to Signing.OnReject when the timestamp is out of the replay window.
+	ErrSignatureExpired = errors.New("signature expired")
+	// ErrReplayed passed to Signing.OnReject when the nonce has been seen in the replay window.
+	ErrReplayed = errors.New("message replayed")
+)
+
+// Signing is a PayloadCodec signing payloads with HMAC-SHA256 on publish, and verifying them on receive.
+//
+// Messages failed to verify are passed to OnReject instead of the MessageHandler. Note that retained
+// messages older than ReplayWindow are rejected too.
+type Signing struct {
+	// KeyID selects the key in Keys used for signing.
+	KeyID string
+	// Keys are the HMAC keys by key ID, all of them are accepted on receive. KeyID and Keys are read
+	// without lock, they must not be modified after installed, keys are rotated by a new client.
+	Keys map[string][]byte
+	// Topics are the topic filters of messages signed and verified, nil means all topics.
+	Topics []string
+	// ReplayWindow is the max difference between the timestamp and local clock, 0 means 5 minutes.
+	ReplayWindow time.Duration
+	// OnReject is called with the messages failed to verify. nil means logging.
+	OnReject func(Message, error)
+
+	noncesLock sync.Mutex
+	nonces     map[[signingNonceSize]byte]time.Time // nonce -> expire time
+	lastPurge  time.Time
+}
+
+func (s *Signing) window() time.Duration {
+	if s.ReplayWindow <= 0 {
+		return defaultReplayWindow
+	}
+
+	return s.ReplayWindow
+}
+
+// Interceptor returns the PublishInterceptor signing payloads.
+func (s *Signing) Interceptor() PublishInterceptor {
+	return payloadInterceptor(func(p *Publication) ([]byte, error) {
+		if !matchTopics(s.Topics, p.Topic) {
+			return p.Payload, nil
+		}
+
+		payload, err := s.sign(p.Topic, p.Payload, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign payload, %w", err)
+		}
+
+		return payload, nil
+	})
+}
+
+func (s *Signing) sign(name string, payload []byte, now time.Time) ([]byte, error) {
+	key, ok := s.Keys[s.KeyID]
+	if !ok || len(s.KeyID) == 0 || len(s.KeyID) > 255 {
+		return nil, fmt.Errorf("invalid signing key %q", s.KeyID)
+	}
+
+	buf := signingEnvelope.header(s.KeyID, 8+signingNonceSize+len(payload)+sha256.Size)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(now.UnixNano()))
+
+	nonce := make([]byte, signingNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	buf = append(buf, nonce...)
+	buf = append(buf, payload...)
+	return append(buf, signature(key, buf, name)...), nil
+}
+
+func signature(key, data []byte, name string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(name)))) // so the payload can not be moved into the topic
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// Middleware returns the Middleware verifying payloads.
+func (s *Signing) Middleware() Middleware {
+	return payloadMiddleware(func(msg Message) ([]byte, error) {
+		if !matchTopics(s.Topics, msg.Topic()) {
+			return msg.Payload(), nil
+		}
+
+		return s.verify(msg.Topic(), msg.Payload(), time.Now())
+	}, s.OnReject)
+}
+
+func (s *Signing) verify(name string, payload []byte, now time.Time) ([]byte, error) {
+	if !signingEnvelope.is(payload) {
+		return nil, ErrNotSigned
+	}
+
+	header, keyID, data, err := signingEnvelope.parse(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 8+signingNonceSize+sha256.Size {
+		return nil, ErrInvalidSignature
+	}
+
+	key, ok := s.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+
+	signed, mac := payload[:len(payload)-sha256.Size], payload[len(payload)-sha256.Size:]
+	if !hmac.Equal(mac, signature(key, signed, name)) {
+		return nil, ErrInvalidSignature
+	}
+
+	ts := int64(binary.BigEndian.Uint64(data))
+	window := s.window()
+	if d := now.Sub(time.Unix(0, ts)); d > window || d < -window {
+		return nil, ErrSignatureExpired
+	}
+
+	var nonce [signingNonceSize]byte
+	copy(nonce[:], data[8:])
+	if !s.remember(nonce, now) {
+		return nil, ErrReplayed
+	}
+
+	return signed[len(header)+8+signingNonceSize:], nil
+}
+
+// remember records the nonce, returns false if it has been seen in the replay window.
+func (s *Signing) remember(nonce [signingNonceSize]byte, now time.Time) bool {
+	s.noncesLock.Lock()
+	defer s.noncesLock.Unlock()
+	if s.nonces == nil {
+		s.nonces = make(map[[signingNonceSize]byte]time.Time)
+	}
+
+	window := s.window()
+	if now.Sub(s.lastPurge) > window {
+		for n, expire := range s.nonces {
+			if now.After(expire) {
+				delete(s.nonces, n)
+			}
+		}
+		s.lastPurge = now
+	}
+
+	if expire, ok := s.nonces[nonce]; ok && !now.After(expire) {
+		return false
+	}
+
+	// a message is accepted up to window after its timestamp, so 2 * window covers it
+	s.nonces[nonce] = now.Add(2 * window)
+	return true
+}
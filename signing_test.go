@@ -0,0 +1,28 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignatureBindsTopic(t *testing.T) {
+	s := &Signing{KeyID: "k1", Keys: map[string][]byte{"k1": []byte("secret")}}
+	now := time.Now()
+	signed, err := s.sign("c", []byte("ab"), now)
+	if err != nil {
+		t.Fatalf("failed to sign, %v", err)
+	}
+
+	// move the last byte of payload into the topic, the signed bytes are the same without the topic length
+	mac := signed[len(signed)-32:]
+	moved := append(append([]byte{}, signed[:len(signed)-33]...), mac...)
+	if _, err := s.verify("bc", moved, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expect ErrInvalidSignature, got %v", err)
+	}
+
+	payload, err := s.verify("c", signed, now)
+	if err != nil || string(payload) != "ab" {
+		t.Errorf("expect ab, got %q, %v", payload, err)
+	}
+}
@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+// Stats is a snapshot of the client status, eg: for health endpoints.
+type Stats struct {
+	Connected      bool
+	Uptime         time.Duration // since the connection established, 0 if not connected
+	Server         *url.URL      // the server connected last time, nil if never connected
+	SessionPresent bool          // the session present flag of CONNACK
+
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesSent       uint64
+	BytesReceived   uint64
+
+	Inflight int // requests waiting for response
+
+	// QueuedOffline is the number of packets queued but not written yet. Messages are not queued
+	// while disconnected, Publish fails with ErrNotConnected, so they are the packets waiting for the writer.
+	QueuedOffline int
+
+	LastPingRTT time.Duration // round trip of the last PINGREQ, including keepalive ones. 0 if unknown
+}
+
+// counters are the packet and byte counters of client since created.
+type counters struct {
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+}
+
+// pendingPing is a PINGREQ waiting for PINGRESP, which carries no packet identifier,
+// so they are matched in order.
+type pendingPing struct {
+	sentAt time.Time
+	done   chan time.Duration // nil for keepalive pings
+}
+
+func (c *client) Stats() Stats {
+	s := Stats{
+		Connected:       c.IsConnected(),
+		Server:          c.server.Load(),
+		SessionPresent:  c.sessionPresent.Load(),
+		PacketsSent:     c.counters.packetsSent.Load(),
+		PacketsReceived: c.counters.packetsReceived.Load(),
+		BytesSent:       c.counters.bytesSent.Load(),
+		BytesReceived:   c.counters.bytesReceived.Load(),
+		Inflight:        c.inflight.len(),
+		QueuedOffline:   c.connection().outgoing.len(),
+		LastPingRTT:     time.Duration(c.lastPingRTT.Load()),
+	}
+	if s.Connected {
+		s.Uptime = time.Since(time.Unix(0, c.connectedAt.Load()))
+	}
+
+	return s
+}
+
+func (c *client) Ping(ctx context.Context) (time.Duration, error) {
+	if !c.IsConnected() {
+		return 0, ErrNotConnected
+	}
+
+	done := make(chan time.Duration, 1)
+	if err := c.sendPing(done); err != nil {
+		return 0, err
+	}
+
+	select {
+	case rtt, ok := <-done:
+		if !ok {
+			return 0, ErrDisconnected
+		}
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, wrapTimeout(ctx.Err())
+	}
+}
+
+// sendPing sends PINGREQ, done receives the round trip time, and is closed if the connection is lost.
+func (c *client) sendPing(done chan time.Duration) error {
+	// queued before sending, the PINGRESP might be handled before sendPacket returns.
+	p := &pendingPing{time.Now(), done}
+	c.pingsLock.Lock()
+	c.pings = append(c.pings, p)
+	c.pingsLock.Unlock()
+	if err := c.sendPacket(&packet.PingReq{}); err != nil {
+		c.pingsLock.Lock()
+		c.pings = slices.DeleteFunc(c.pings, func(q *pendingPing) bool { return q == p })
+		c.pingsLock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// pingResponded completes the earliest ping.
+func (c *client) pingResponded() {
+	c.pingsLock.Lock()
+	if len(c.pings) == 0 {
+		c.pingsLock.Unlock()
+		c.log(LogWarn, "receive unexpected packet", packetFields(&packet.PingResp{})...)
+		return
+	}
+
+	p := c.pings[0]
+	c.pings = c.pings[1:]
+	c.pingsLock.Unlock()
+
+	rtt := time.Since(p.sentAt)
+	c.lastPingRTT.Store(int64(rtt))
+	if p.done != nil {
+		p.done <- rtt
+	}
+}
+
+// failPings closes the pending pings, called when the connection is lost.
+func (c *client) failPings() {
+	c.pingsLock.Lock()
+	pings := c.pings
+	c.pings = nil
+	c.pingsLock.Unlock()
+
+	for _, p := range pings {
+		if p.done != nil {
+			close(p.done)
+		}
+	}
+}
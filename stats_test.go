@@ -0,0 +1,36 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+func TestSendPingFailed(t *testing.T) {
+	c := &client{state: newConnState()} // the writer is not running
+	if err := c.sendPing(nil); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expect ErrNotConnected, got %v", err)
+	}
+
+	if len(c.pings) != 0 {
+		t.Errorf("failed ping still pending, %d", len(c.pings))
+	}
+}
+
+func TestStatsQueued(t *testing.T) {
+	c := &client{state: newConnState(), inflight: newInflightTable(0, func(int) {})}
+	q := c.state.outgoing
+	q.open() // the writer is not running, packets stay queued
+	q.push(laneControl, &outgoing{packet: &packet.PingReq{}, done: make(chan error, 1)})
+	q.push(laneLow, &outgoing{packet: &packet.Publish{Topic: "a"}, done: make(chan error, 1)})
+
+	if n := c.Stats().QueuedOffline; n != 2 {
+		t.Errorf("expect 2 queued packets, got %d", n)
+	}
+
+	q.close(ErrDisconnected)
+	if n := c.Stats().QueuedOffline; n != 0 {
+		t.Errorf("expect no queued packets after close, got %d", n)
+	}
+}
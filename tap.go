@@ -0,0 +1,39 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+// Direction is the direction of packet on the wire.
+type Direction int
+
+const (
+	DirectionIn  Direction = iota + 1 // read from server
+	DirectionOut                      // written to server
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionIn:
+		return "in"
+	case DirectionOut:
+		return "out"
+	default:
+		return "unknown"
+	}
+}
+
+// PacketEvent is a packet read or written by client.
+type PacketEvent struct {
+	Direction Direction
+	Time      time.Time
+	Packet    packet.ControlPacket // decoded packet, eg: *packet.Publish
+	Raw       []byte               // the bytes on the wire, must not be modified
+}
+
+// PacketTap is called with every packet read from and written to the connection, outgoing packets are
+// tapped just before writing. It runs in the goroutine using the connection, and must be fast and safe
+// for concurrent use.
+type PacketTap func(ev PacketEvent)
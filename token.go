@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token tracks the completion of an asynchronous operation, such as PublishAsync.
+type Token interface {
+	// Wait blocks until the operation completes or ctx is done.
+	Wait(ctx context.Context) error
+
+	// Done returns a channel which is closed when the operation completes.
+	Done() <-chan struct{}
+
+	// Err returns the result of the operation, it's nil until Done is closed.
+	Err() error
+}
+
+type token struct {
+	id     uint16    // packet identifier of the request, 0 if no response expected
+	sentAt time.Time // when the PUBLISH is written to the connection, guarded by the inflightTable
+	once   sync.Once
+	done   chan struct{}
+	resp   interface{} // response packet, eg: *packet.PubAck
+	err    error
+}
+
+func newToken() *token {
+	return &token{done: make(chan struct{})}
+}
+
+func newCompletedToken(err error) *token {
+	t := newToken()
+	t.complete(nil, err)
+	return t
+}
+
+// complete sets the result of the token, only the first call takes effect.
+func (t *token) complete(resp interface{}, err error) {
+	t.once.Do(func() {
+		t.resp = resp
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *token) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return wrapTimeout(ctx.Err())
+	}
+}
+
+func (t *token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *token) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+// Package topic contains MQTT topic name and topic filter helpers, such as matching and validation.
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	separator      = "/"
+	singleWildcard = "+"
+	multiWildcard  = "#"
+)
+
+// Match reports whether the topic name matches the topic filter.
+//
+// The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+// with Topic Names beginning with a $ character [MQTT-4.7.2-1].
+func Match(filter, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, singleWildcard) || strings.HasPrefix(filter, multiWildcard)) {
+		return false
+	}
+
+	fl := strings.Split(filter, separator)
+	nl := strings.Split(name, separator)
+	for i, f := range fl {
+		if f == multiWildcard {
+			return true
+		}
+
+		if i >= len(nl) {
+			return false
+		}
+
+		if f != singleWildcard && f != nl[i] {
+			return false
+		}
+	}
+
+	return len(fl) == len(nl)
+}
+
+// maxLength is the max length of UTF-8 encoded string in MQTT.
+const maxLength = 65535
+
+var (
+	ErrEmpty               = errors.New("topic must be at least one character long")
+	ErrTooLong             = errors.New("topic exceeds 65535 bytes")
+	ErrInvalidUTF8         = errors.New("topic is not well-formed UTF-8")
+	ErrNullCharacter       = errors.New("topic contains U+0000")
+	ErrWildcardInName      = errors.New("wildcard characters are not allowed in topic name")
+	ErrMultiLevelWildcard  = errors.New("multi-level wildcard must be the last character and occupy an entire level")
+	ErrSingleLevelWildcard = errors.New("single-level wildcard must occupy an entire level")
+)
+
+// Error records the invalid topic and the reason.
+type Error struct {
+	Topic string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid topic %q, %s", e.Topic, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ValidateName checks the topic name used in PUBLISH.
+//
+// The wildcard characters can be used in Topic Filters, but MUST NOT be used within a Topic Name [MQTT-4.7.1-1].
+func ValidateName(name string) error {
+	if err := validate(name); err != nil {
+		return &Error{name, err}
+	}
+
+	if strings.ContainsAny(name, singleWildcard+multiWildcard) {
+		return &Error{name, ErrWildcardInName}
+	}
+
+	return nil
+}
+
+// ValidateFilter checks the topic filter used in SUBSCRIBE and UNSUBSCRIBE.
+func ValidateFilter(filter string) error {
+	if err := validate(filter); err != nil {
+		return &Error{filter, err}
+	}
+
+	levels := strings.Split(filter, separator)
+	for i, level := range levels {
+		switch {
+		case strings.Contains(level, multiWildcard):
+			// The multi-level wildcard character MUST be specified either on its own or following a topic level separator.
+			// In either case it MUST be the last character specified in the Topic Filter [MQTT-4.7.1-2].
+			if level != multiWildcard || i != len(levels)-1 {
+				return &Error{filter, ErrMultiLevelWildcard}
+			}
+		case strings.Contains(level, singleWildcard):
+			// Where it is used it MUST occupy an entire level of the filter [MQTT-4.7.1-3].
+			if level != singleWildcard {
+				return &Error{filter, ErrSingleLevelWildcard}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate checks the rules shared by topic name and topic filter.
+//
+// All Topic Names and Topic Filters MUST be at least one character long [MQTT-4.7.3-1].
+// Topic Names and Topic Filters MUST NOT include the null character (Unicode U+0000) [MQTT-4.7.3-2].
+// Topic Names and Topic Filters are UTF-8 encoded strings, they MUST NOT encode to more than 65535 bytes [MQTT-4.7.3-3].
+func validate(s string) error {
+	if len(s) == 0 {
+		return ErrEmpty
+	}
+
+	if len(s) > maxLength {
+		return ErrTooLong
+	}
+
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+
+	if strings.ContainsRune(s, 0) {
+		return ErrNullCharacter
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package topic
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, name string
+		match        bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/tennis/player2", false},
+		{"sport/tennis/player1", "sport/tennis", false},
+		{"sport/tennis", "sport/tennis/player1", false},
+
+		// multi-level wildcard
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"sport/#", "sports", false},
+		{"#", "sport/tennis", true},
+		{"#", "/", true},
+
+		// single-level wildcard
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+", "sport", true},
+		{"+", "/finance", false},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+/tennis/#", "sport/tennis/player1", true},
+
+		// empty levels
+		{"a//b", "a//b", true},
+		{"a/+/b", "a//b", true},
+		{"a/b", "a//b", false},
+		{"/", "/", true},
+
+		// topics beginning with $
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"a/#", "a/$SYS", true},
+	}
+
+	for _, c := range cases {
+		if got := Match(c.filter, c.name); got != c.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.filter, c.name, got, c.match)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"sport/tennis", nil},
+		{"/", nil},
+		{"a//b", nil},
+		{"$SYS/broker", nil},
+		{"café", nil},
+		{strings.Repeat("a", maxLength), nil},
+
+		{"", ErrEmpty},
+		{strings.Repeat("a", maxLength+1), ErrTooLong},
+		{"a\xffb", ErrInvalidUTF8},
+		{"a\x00b", ErrNullCharacter},
+		{"sport/+", ErrWildcardInName},
+		{"sport/#", ErrWildcardInName},
+		{"sport+", ErrWildcardInName},
+	}
+
+	for _, c := range cases {
+		checkError(t, "ValidateName", c.name, ValidateName(c.name), c.err)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		err    error
+	}{
+		{"sport/tennis", nil},
+		{"#", nil},
+		{"+", nil},
+		{"/#", nil},
+		{"+/+", nil},
+		{"sport/+/player1", nil},
+		{"sport/tennis/#", nil},
+		{"a//+", nil},
+		{"$SYS/#", nil},
+		{strings.Repeat("a", maxLength), nil},
+
+		{"", ErrEmpty},
+		{strings.Repeat("a", maxLength+1), ErrTooLong},
+		{"a\xffb", ErrInvalidUTF8},
+		{"a\x00b", ErrNullCharacter},
+		{"sport/tennis#", ErrMultiLevelWildcard},
+		{"sport/#/ranking", ErrMultiLevelWildcard},
+		{"#/", ErrMultiLevelWildcard},
+		{"##", ErrMultiLevelWildcard},
+		{"sport+", ErrSingleLevelWildcard},
+		{"sport/+tennis", ErrSingleLevelWildcard},
+		{"++", ErrSingleLevelWildcard},
+	}
+
+	for _, c := range cases {
+		checkError(t, "ValidateFilter", c.filter, ValidateFilter(c.filter), c.err)
+	}
+}
+
+func checkError(t *testing.T, fn, s string, err, want error) {
+	t.Helper()
+	if len(s) > 32 {
+		s = s[:32] + "..."
+	}
+
+	if want == nil {
+		if err != nil {
+			t.Errorf("%s(%q) = %v, want nil", fn, s, err)
+		}
+		return
+	}
+
+	var topicErr *Error
+	if !errors.Is(err, want) || !errors.As(err, &topicErr) {
+		t.Errorf("%s(%q) = %v, want %v", fn, s, err, want)
+	}
+}
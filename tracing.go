@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// traceEnvelope marks the payloads carrying a W3C traceparent, the field is the traceparent.
+// MQTT 3.1.1 has no user properties, so the trace context is put in payload.
+var traceEnvelope = payloadEnvelope{"trace", []byte{0x00, 'T'}, 1}
+
+// ErrInvalidTraceParent is returned by ParseTraceParent.
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// SpanContext identifies a span across processes, see https://www.w3.org/TR/trace-context/.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte // 0x01 means sampled
+}
+
+// IsValid reports whether both TraceID and SpanID are not zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the traceparent header value, eg: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceParent parses the traceparent header value of version 00.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	if len(s) != 55 || s[:3] != "00-" || s[35] != '-' || s[52] != '-' {
+		return sc, ErrInvalidTraceParent
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(flags[:], []byte(s[53:])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceParent
+	}
+
+	return sc, nil
+}
+
+// SpanKind is the role of span, the same as OpenTelemetry.
+type SpanKind int
+
+const (
+	SpanKindProducer SpanKind = iota + 1 // around Publish
+	SpanKindConsumer                     // around handling an incoming message
+)
+
+// Span is a span started by Tracer.
+type Span interface {
+	SpanContext() SpanContext
+	// End finishes the span, err is the result of the operation.
+	End(err error)
+}
+
+// Tracer starts spans, implement it to back Tracing with any tracing system.
+type Tracer interface {
+	// Start starts a span, parent is the span of caller found by SpanFromContext(ctx), or the remote span
+	// extracted from the incoming message. It's invalid if there is none, and a new trace should be started.
+	// The ctx could be used to find the parent span kept by the tracing system itself.
+	Start(ctx context.Context, name string, kind SpanKind, parent SpanContext) Span
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, Publish with it propagates the span to subscribers.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, it's the consumer span in the context of a message.
+func SpanFromContext(ctx context.Context) (Span, bool) {
+	span, ok := ctx.Value(spanKey{}).(Span)
+	return span, ok
+}
+
+// Tracing is a PayloadCodec starting spans around publishing and handling, and propagating the trace context in payloads.
+type Tracing struct {
+	Tracer Tracer
+	// Topics are the topic filters of messages carrying the trace context, nil means all topics. All publishers
+	// of them must use Tracing, payloads of others are delivered as is, even if starting with the envelope magic.
+	Topics []string
+}
+
+// Interceptor returns the PublishInterceptor starting a producer span and injecting its traceparent.
+func (t *Tracing) Interceptor() PublishInterceptor {
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, p *Publication) error {
+			var parent SpanContext
+			if span, ok := SpanFromContext(ctx); ok {
+				parent = span.SpanContext()
+			}
+
+			span := t.Tracer.Start(ctx, "publish "+p.Topic, SpanKindProducer, parent)
+			if !isClearRetained(ctx) && matchTopics(t.Topics, p.Topic) {
+				p.Payload = injectTrace(span.SpanContext(), p.Payload)
+			}
+			err := next(ContextWithSpan(ctx, span), p)
+			span.End(err)
+			return err
+		}
+	}
+}
+
+func injectTrace(sc SpanContext, payload []byte) []byte {
+	tp := ""
+	if sc.IsValid() {
+		tp = sc.TraceParent()
+	}
+
+	return append(traceEnvelope.header(tp, len(payload)), payload...)
+}
+
+// Middleware returns the Middleware extracting the traceparent and starting a consumer span,
+// which is carried by the context of message, see MessageContext and SpanFromContext.
+func (t *Tracing) Middleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(msg Message) {
+			var parent SpanContext
+			if sc, payload, ok := extractTrace(msg.Payload()); ok && matchTopics(t.Topics, msg.Topic()) {
+				parent, msg = sc, withPayload(msg, payload)
+			}
+
+			ctx := MessageContext(msg)
+			span := t.Tracer.Start(ctx, "process "+msg.Topic(), SpanKindConsumer, parent)
+			defer span.End(nil)
+			next(withContext(msg, ContextWithSpan(ctx, span)))
+		}
+	}
+}
+
+// extractTrace returns the span context and the original payload, ok is false if there is no valid envelope,
+// whose traceparent is empty if the publisher had no valid span.
+func extractTrace(payload []byte) (sc SpanContext, data []byte, ok bool) {
+	_, tp, data, err := traceEnvelope.parse(payload)
+	if err != nil {
+		return sc, payload, false
+	}
+
+	if tp == "" {
+		return sc, data, true
+	}
+
+	if sc, err = ParseTraceParent(tp); err != nil { // not an envelope, don't guess
+		return sc, payload, false
+	}
+
+	return sc, data, true
+}
@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"context"
+
+	"github.com/openim/mqtt-client/codec"
+)
+
+// PublishTyped encodes v with cd, and publishes it to topic.
+func PublishTyped[T any](ctx context.Context, c Client, cd codec.Codec, topic string, qos byte, retained bool, v T) error {
+	payload, err := cd.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.Publish(ctx, topic, qos, retained, payload)
+}
+
+// SubscribeTyped subscribes topic, and calls handler with the payload decoded into T.
+// Messages failed to decode are passed to onError, which could be nil.
+func SubscribeTyped[T any](ctx context.Context, c Client, cd codec.Codec, topic string, qos byte,
+	handler func(Message, T), onError func(Message, error)) error {
+	return c.Subscribe(ctx, topic, qos, TypedHandler(cd, handler, onError))
+}
+
+// TypedHandler adapts handler to a MessageHandler, which decodes the payload into T with cd.
+func TypedHandler[T any](cd codec.Codec, handler func(Message, T), onError func(Message, error)) MessageHandler {
+	return func(msg Message) {
+		var v T
+		if err := cd.Unmarshal(msg.Payload(), &v); err != nil {
+			if onError != nil {
+				onError(msg, err)
+			} else {
+				messageLogger(msg).Log(LogWarn, "failed to decode message", LogFieldTopic, msg.Topic(), LogFieldError, err)
+			}
+			return
+		}
+
+		handler(msg, v)
+	}
+}
@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+// Priority is the priority of outgoing PUBLISH packets, set by WithPriority.
+// Packets of higher priority are written first, the order of the same priority is preserved.
+// A lane waiting for 16 packets of higher priority is served once, so low priority packets are not starved.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1 // eg: bulk telemetry
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1 // eg: alarms
+)
+
+// lanes of the outgoing queue, control packets (acks, PINGREQ, SUBSCRIBE, ...) are always written first.
+const (
+	laneControl = iota
+	laneHigh
+	laneNormal
+	laneLow
+	numLanes
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying the priority of the messages published with it.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority set by WithPriority, PriorityNormal if not set.
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+
+	return PriorityNormal
+}
+
+func publishLane(ctx context.Context) int {
+	switch p := PriorityFromContext(ctx); {
+	case p > PriorityNormal:
+		return laneHigh
+	case p < PriorityNormal:
+		return laneLow
+	default:
+		return laneNormal
+	}
+}
+
+// defaultWriteBufferSize is the size of the buffer coalescing outgoing packets.
+const defaultWriteBufferSize = 4096
+
+// outgoing is an encoded packet waiting to be written.
+type outgoing struct {
+	packet packet.ControlPacket
+	raw    []byte
+	done   chan error
+}
+
+// starvationLimit is the number of PUBLISH packets written ahead of a waiting lane, before one of it is written.
+const starvationLimit = 16
+
+// outgoingQueue keeps the packets waiting for the writer in lanes of priority.
+type outgoingQueue struct {
+	sync.Mutex
+	lanes   [numLanes][]*outgoing
+	skipped [numLanes]int // number of packets written while the lane is waiting
+	ready   chan struct{} // signaled when packets are queued
+	err     error         // set when the writer is not running, new packets fail fast
+}
+
+func newOutgoingQueue() *outgoingQueue {
+	return &outgoingQueue{
+		ready: make(chan struct{}, 1),
+		err:   ErrNotConnected,
+	}
+}
+
+func (q *outgoingQueue) push(lane int, o *outgoing) error {
+	q.Lock()
+	if q.err != nil {
+		q.Unlock()
+		return q.err
+	}
+	q.lanes[lane] = append(q.lanes[lane], o)
+	q.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default: // the writer is signaled already
+	}
+	return nil
+}
+
+// pop returns the first packet of the highest priority lane. A PUBLISH lane having waited for
+// starvationLimit packets is served first once, so the low priority ones are not blocked forever.
+func (q *outgoingQueue) pop() (*outgoing, bool) {
+	q.Lock()
+	defer q.Unlock()
+	lane := -1
+	for i, l := range q.lanes {
+		if len(l) == 0 {
+			continue
+		}
+
+		if lane < 0 {
+			lane = i
+			if lane == laneControl {
+				break
+			}
+		} else if q.skipped[i] >= starvationLimit {
+			lane = i
+			break
+		}
+	}
+
+	if lane < 0 {
+		return nil, false
+	}
+
+	if lane != laneControl {
+		for i := laneHigh; i < numLanes; i++ {
+			if len(q.lanes[i]) > 0 {
+				q.skipped[i]++
+			} else {
+				q.skipped[i] = 0
+			}
+		}
+		q.skipped[lane] = 0
+	}
+
+	l := q.lanes[lane]
+	o := l[0]
+	l[0] = nil
+	q.lanes[lane] = l[1:]
+	return o, true
+}
+
+// remove takes o out of the queue, it returns false if o has been taken by the writer.
+func (q *outgoingQueue) remove(lane int, o *outgoing) bool {
+	q.Lock()
+	defer q.Unlock()
+	i := slices.Index(q.lanes[lane], o)
+	if i < 0 {
+		return false
+	}
+
+	q.lanes[lane] = slices.Delete(q.lanes[lane], i, i+1)
+	return true
+}
+
+// len returns the number of packets waiting for the writer.
+func (q *outgoingQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	n := 0
+	for _, l := range q.lanes {
+		n += len(l)
+	}
+	return n
+}
+
+// open accepts new packets after the writer started.
+func (q *outgoingQueue) open() {
+	q.Lock()
+	q.err = nil
+	q.Unlock()
+}
+
+// close fails the queued packets and the new ones with err.
+func (q *outgoingQueue) close(err error) {
+	q.Lock()
+	lanes := q.lanes
+	q.lanes = [numLanes][]*outgoing{}
+	q.skipped = [numLanes]int{}
+	q.err = err
+	q.Unlock()
+
+	for _, l := range lanes {
+		for _, o := range l {
+			o.done <- err
+		}
+	}
+}
+
+// writeLoop writes the queued packets in the order of priority until the connection is closed.
+// Packets are coalesced in a buffer, which is flushed when the queue is empty or the buffer is full,
+// and the senders are notified after flushing.
+func (c *client) writeLoop(conn net.Conn, st *connState) {
+	defer c.wg.Done()
+	size := c.options.WriteBufferSize
+	if size == 0 {
+		size = defaultWriteBufferSize
+	}
+
+	w := bufio.NewWriterSize(conn, max(size, defaultWriteBufferSize))
+	var batch []*outgoing
+	for {
+		select {
+		case <-st.outgoing.ready:
+		case <-st.exitChan:
+			goto EXIT
+		case <-st.outgoingLoopExitChan:
+			goto EXIT
+		}
+
+		for o, ok := st.outgoing.pop(); ok; o, ok = st.outgoing.pop() {
+			if err := c.writePacket(w, o.packet, o.raw); err != nil {
+				c.flush(w, batch)
+				batch = batch[:0]
+				o.done <- err
+				continue
+			}
+
+			batch = append(batch, o)
+			if size < 0 || w.Buffered() >= size {
+				c.flush(w, batch)
+				batch = batch[:0]
+			}
+		}
+
+		if len(batch) > 0 {
+			c.flush(w, batch)
+			batch = batch[:0]
+		}
+	}
+
+EXIT:
+	st.outgoing.close(ErrDisconnected)
+}
+
+// flush writes the buffered packets to the connection, and notifies their senders.
+func (c *client) flush(w *bufio.Writer, batch []*outgoing) {
+	err := w.Flush()
+	if err != nil {
+		c.log(LogError, "failed to flush packets", LogFieldError, err)
+	}
+
+	for i, o := range batch {
+		if err == nil {
+			c.packetSent(o.packet, o.raw)
+		}
+		o.done <- err
+		batch[i] = nil
+	}
+}
@@ -0,0 +1,333 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openim/mqtt-client/packet"
+)
+
+// countingConn counts the writes reaching the connection.
+type countingConn struct {
+	net.Conn
+	lock   sync.Mutex
+	writes int
+	bytes  int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.lock.Lock()
+	c.writes++
+	c.bytes += n
+	c.lock.Unlock()
+	return n, err
+}
+
+func (c *countingConn) count() (writes, bytes int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.writes, c.bytes
+}
+
+// startWriter runs the writeLoop of a client on a pipe, whose other end is drained.
+func startWriter(t *testing.T, tap func(PacketEvent), writeBufferSize int) (*client, *countingConn) {
+	c := NewClient(Options{PacketTap: tap, WriteBufferSize: writeBufferSize}).(*client)
+	conn := &countingConn{Conn: drainedPipe(t)}
+	runWriter(t, c, conn)
+	return c, conn
+}
+
+// drainedPipe returns a connection whose other end is drained.
+func drainedPipe(t testing.TB) net.Conn {
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local
+}
+
+// runWriter runs the writeLoop of c on conn until the test ends.
+func runWriter(t testing.TB, c *client, conn net.Conn) {
+	st := c.connection()
+	st.outgoing.open()
+	c.wg.Add(1)
+	go c.writeLoop(conn, st)
+	t.Cleanup(func() {
+		close(st.exitChan)
+		c.wg.Wait()
+	})
+}
+
+// gatedTap holds the writer at the PUBLISH to topic "block" until released, and records the topics written.
+type gatedTap struct {
+	blocked chan struct{}
+	release chan struct{}
+	lock    sync.Mutex
+	written []string
+}
+
+func newGatedTap() *gatedTap {
+	return &gatedTap{blocked: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (g *gatedTap) tap(ev PacketEvent) {
+	p, ok := ev.Packet.(*packet.Publish)
+	if !ok {
+		return
+	}
+
+	if p.Topic == "block" {
+		close(g.blocked)
+		<-g.release
+	}
+	g.lock.Lock()
+	g.written = append(g.written, p.Topic)
+	g.lock.Unlock()
+}
+
+// queue pushes the PUBLISH of topic behind the blocked one, and returns its done channel.
+func queue(t *testing.T, c *client, lane int, topic string) chan error {
+	return queuePayload(t, c, lane, topic, nil)
+}
+
+func queuePayload(t *testing.T, c *client, lane int, topic string, payload []byte) chan error {
+	p := &packet.Publish{Topic: topic, Payload: payload}
+	raw, err := encodePacket(p)
+	if err != nil {
+		t.Fatalf("failed to encode, %v", err)
+	}
+
+	o := &outgoing{p, raw, make(chan error, 1)}
+	if err := c.connection().outgoing.push(lane, o); err != nil {
+		t.Fatalf("failed to queue, %v", err)
+	}
+
+	return o.done
+}
+
+func block(t *testing.T, c *client, g *gatedTap) chan error {
+	done := queue(t, c, laneNormal, "block")
+	<-g.blocked
+	return done
+}
+
+func waitAll(t *testing.T, done []chan error) {
+	for _, d := range done {
+		select {
+		case err := <-d:
+			if err != nil {
+				t.Fatalf("failed to write, %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("packet not written")
+		}
+	}
+}
+
+func TestPriorityLanes(t *testing.T) {
+	g := newGatedTap()
+	c, _ := startWriter(t, g.tap, 0)
+	done := []chan error{block(t, c, g)}
+	for i := 0; i < 5; i++ {
+		done = append(done, queue(t, c, laneLow, "bulk"))
+	}
+	done = append(done, queue(t, c, laneNormal, "normal"), queue(t, c, laneHigh, "alarm"))
+	close(g.release)
+	waitAll(t, done)
+
+	want := []string{"block", "alarm", "normal", "bulk", "bulk", "bulk", "bulk", "bulk"}
+	if !slices.Equal(g.written, want) {
+		t.Errorf("unexpected order, %v", g.written)
+	}
+}
+
+func TestLowLaneNotStarved(t *testing.T) {
+	g := newGatedTap()
+	c, _ := startWriter(t, g.tap, 0)
+	done := []chan error{block(t, c, g), queue(t, c, laneLow, "bulk")}
+	for i := 0; i < 2*starvationLimit; i++ {
+		done = append(done, queue(t, c, laneHigh, "alarm"))
+	}
+	close(g.release)
+	waitAll(t, done)
+
+	if i := slices.Index(g.written, "bulk"); i != starvationLimit+1 {
+		t.Errorf("expect the low priority packet written after %d others, got %d", starvationLimit, i-1)
+	}
+}
+
+func TestQueuedPacketCancelled(t *testing.T) {
+	g := newGatedTap()
+	c, _ := startWriter(t, g.tap, 0)
+	blocked := block(t, c, g)
+
+	// the writer is blocked, so the packet is still queued when ctx is checked
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.sendPacketLane(ctx, &packet.Publish{Topic: "cancelled"}, laneNormal); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+
+	done := queue(t, c, laneNormal, "next")
+	close(g.release)
+	waitAll(t, []chan error{blocked, done})
+	if slices.Contains(g.written, "cancelled") {
+		t.Errorf("cancelled packet written, %v", g.written)
+	}
+}
+
+func TestWriteCoalesced(t *testing.T) {
+	cases := []struct {
+		name            string
+		writeBufferSize int
+		payloadSize     int
+		minWrites       int
+		maxWrites       int
+	}{
+		{"coalesced", 0, 10, 1, 1},
+		{"size threshold", 4096, 1000, 2, 4},
+		{"unbuffered", -1, 10, 11, 11},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newGatedTap()
+			c, conn := startWriter(t, g.tap, tc.writeBufferSize)
+			done := []chan error{block(t, c, g)}
+			for i := 0; i < 10; i++ {
+				done = append(done, queuePayload(t, c, laneNormal, "data", make([]byte, tc.payloadSize)))
+			}
+			close(g.release)
+			waitAll(t, done)
+
+			if writes, _ := conn.count(); writes < tc.minWrites || writes > tc.maxWrites {
+				t.Errorf("expect %d to %d writes for 11 packets, got %d", tc.minWrites, tc.maxWrites, writes)
+			}
+		})
+	}
+}
+
+func TestLonePacketFlushed(t *testing.T) {
+	c, conn := startWriter(t, nil, 0)
+	p := &packet.Publish{Topic: "alone", Payload: []byte("data")}
+	raw, err := encodePacket(p)
+	if err != nil {
+		t.Fatalf("failed to encode, %v", err)
+	}
+
+	// returns after the packet is flushed, the buffer is not waiting to be filled
+	if err := c.sendPacketLane(context.Background(), p, laneNormal); err != nil {
+		t.Fatalf("failed to send, %v", err)
+	}
+
+	if writes, bytes := conn.count(); writes != 1 || bytes != len(raw) {
+		t.Errorf("expect 1 write of %d bytes, got %d writes of %d bytes", len(raw), writes, bytes)
+	}
+}
+
+func TestOldWriterKeepsNewQueue(t *testing.T) {
+	c := NewClient(Options{}).(*client)
+	st := c.connection()
+	st.outgoing.open()
+	c.wg.Add(1)
+	go c.writeLoop(drainedPipe(t), st)
+
+	// the next connection starts before the old writer exits
+	next := newConnState()
+	next.outgoing.open()
+	c.Lock()
+	c.state = next
+	c.Unlock()
+	close(st.exitChan)
+	c.wg.Wait()
+
+	o := &outgoing{packet: &packet.PingReq{}, done: make(chan error, 1)}
+	if err := c.connection().outgoing.push(laneControl, o); err != nil {
+		t.Errorf("the queue of the next connection is closed by the old writer, %v", err)
+	}
+}
+
+// slowConn takes delay for each write, like a congested link or an expensive syscall(eg: TLS).
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+// writeDirect is how sendPacket wrote before the writeLoop, each packet is written under the client mutex.
+func writeDirect(c *client, conn net.Conn, p packet.ControlPacket) error {
+	raw, err := encodePacket(p)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err := c.writePacket(conn, p, raw); err != nil {
+		return err
+	}
+
+	c.packetSent(p, raw)
+	return nil
+}
+
+// BenchmarkWritePublish compares the writeLoop with the direct writes, publishing small QoS 0 messages
+// by concurrent publishers to connections taking 0 or 1ms for each write.
+func BenchmarkWritePublish(b *testing.B) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		for _, publishers := range []int{1, 64} {
+			name := fmt.Sprintf("delay=%s/publishers=%d", delay, publishers)
+			b.Run(name+"/direct", func(b *testing.B) {
+				c := NewClient(Options{}).(*client)
+				conn := &slowConn{drainedPipe(b), delay}
+				benchmarkPublish(b, publishers, func(p *packet.Publish) error {
+					return writeDirect(c, conn, p)
+				})
+			})
+
+			for _, size := range []int{-1, 0} {
+				mode := "unbuffered"
+				if size == 0 {
+					mode = "coalesced"
+				}
+
+				b.Run(name+"/"+mode, func(b *testing.B) {
+					c := NewClient(Options{WriteBufferSize: size}).(*client)
+					runWriter(b, c, &slowConn{drainedPipe(b), delay})
+					benchmarkPublish(b, publishers, func(p *packet.Publish) error {
+						return c.sendPacketLane(context.Background(), p, laneNormal)
+					})
+				})
+			}
+		}
+	}
+}
+
+func benchmarkPublish(b *testing.B, publishers int, send func(p *packet.Publish) error) {
+	payload := []byte("temperature=21.5")
+	b.SetBytes(int64(len(payload)))
+	b.SetParallelism(publishers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := send(&packet.Publish{Topic: "bench/qos0", Payload: payload}); err != nil {
+				b.Errorf("failed to publish, %v", err)
+				return
+			}
+		}
+	})
+}